@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/beorn7/rrsim/sim"
+)
+
+// paramsHandler serves the runtime parameters of s as JSON on GET and changes
+// them on POST. Fields missing in a POSTed JSON object keep their current
+// value.
+func paramsHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			p := s.Params()
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.SetParams(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Params())
+	})
+}
+
+// restartHandler triggers a restart batch of s on POST and responds with the
+// new batch number.
+func restartHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		batch, err := s.Restart(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			Batch int `json:"batch"`
+		}{batch})
+	})
+}
+
+// eventsHandler streams the lifecycle events of s as newline-delimited JSON on
+// GET, until the client goes away or the simulation has finished.
+func eventsHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		events, cancel := s.Subscribe()
+		defer cancel()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+				rc.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// pauseHandler pauses s on POST and responds with whether s is paused, which
+// is also the response on GET.
+func pauseHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			s.Pause()
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writePaused(w, s)
+	})
+}
+
+// resumeHandler resumes s on POST and responds with whether s is paused.
+func resumeHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.Resume()
+		writePaused(w, s)
+	})
+}
+
+func writePaused(w http.ResponseWriter, s *sim.Simulator) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Paused bool `json:"paused"`
+	}{s.Paused()})
+}
+
+// sdGroup is a target group in the format of the Prometheus HTTP service
+// discovery.
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdGroups returns a target group for each live target in ts. Targets
+// listening on an unspecified host are advertised with the given host.
+func sdGroups(ts []*target, host, scheme string) []sdGroup {
+	groups := []sdGroup{}
+	for _, t := range ts {
+		if !t.live() {
+			continue
+		}
+		h, port, err := net.SplitHostPort(t.addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+			h = host
+		}
+		groups = append(groups, sdGroup{
+			Targets: []string{net.JoinHostPort(h, port)},
+			Labels: map[string]string{
+				"job":              *job,
+				"__metrics_path__": *metricsPath,
+				"__scheme__":       scheme,
+			},
+		})
+	}
+	return groups
+}
+
+// sdHandler serves the currently live targets in ts for Prometheus's
+// http_sd_config. Targets listening on an unspecified host are advertised with
+// the host the request was sent to.
+func sdHandler(ts []*target) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqHost, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			reqHost = r.Host
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sdGroups(ts, reqHost, scheme))
+	})
+}
+
+// writeSDFile writes the currently live targets in ts to path for
+// Prometheus's file_sd_config, checking every second for changes until ctx is
+// done, when it writes the file a last time. The file is replaced atomically
+// so that Prometheus never reads a partially written file. Targets listening
+// on an unspecified host are advertised as localhost.
+func writeSDFile(ctx context.Context, path string, ts []*target, scheme string) {
+	var last []byte
+	write := func() {
+		b, err := json.MarshalIndent(sdGroups(ts, "localhost", scheme), "", "  ")
+		if err != nil {
+			slog.Error("Error encoding SD file", "path", path, "err", err)
+			return
+		}
+		if bytes.Equal(b, last) {
+			return
+		}
+		if err := writeFileAtomically(path, append(b, '\n')); err != nil {
+			slog.Error("Error writing SD file", "path", path, "err", err)
+			return
+		}
+		slog.Debug("SD file written", "path", path)
+		last = b
+	}
+	write()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			write()
+			return
+		case <-ticker.C:
+			write()
+		}
+	}
+}
+
+// writeFileAtomically writes b to a temporary file in the directory of path
+// and then renames it to path.
+func writeFileAtomically(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // No-op after a successful rename.
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beorn7/rrsim/sim"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads the YAML file at path, whose keys are flag names.
+func readConfigFile(path string) (map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]any
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	for name := range file {
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown key %q", name)
+		}
+	}
+	return file, nil
+}
+
+// commandLineFlags returns the names of the flags set on the command line.
+func commandLineFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// sortedKeys returns the keys of file in sorted order.
+func sortedKeys(file map[string]any) []string {
+	names := make([]string, 0, len(file))
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadConfigFile sets all flags that have not been set on the command line to
+// the values in the YAML file at path. It returns the content of the file for
+// reloadConfigFile.
+func loadConfigFile(path string) (map[string]any, error) {
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := commandLineFlags()
+	for _, name := range sortedKeys(file) {
+		if set[name] {
+			continue
+		}
+		values, err := flagValues(file[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %w", name, err)
+		}
+		f := flag.Lookup(name)
+		if _, ok := f.Value.(labelsFlag); !ok {
+			// Only -label and -other-metric-help may be repeated,
+			// all other lists are comma-separated.
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", name, err)
+			}
+		}
+	}
+	return file, nil
+}
+
+// runtimeKeys are the keys of the config file that reloadConfigFile applies to
+// a running simulation.
+var runtimeKeys = map[string]func(p *sim.Params, v float64){
+	"qps":        func(p *sim.Params, v float64) { p.QPS = v },
+	"jitter":     func(p *sim.Params, v float64) { p.Jitter = v },
+	"loss":       func(p *sim.Params, v float64) { p.Loss = v },
+	"error-rate": func(p *sim.Params, v float64) { p.ErrorRate = v },
+}
+
+// reloadConfigFile reads the YAML file at path again and applies the values
+// of runtimeKeys that have changed compared to last to the simulations of all
+// targets in ts. Other changes are ignored with a warning, and so are changes
+// of flags set on the command line. It returns the new content of the file.
+// Nothing is applied if the file or any of the changed runtime values is
+// invalid.
+func reloadConfigFile(path string, last map[string]any, ts []*target) (map[string]any, error) {
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := commandLineFlags()
+	changed := map[string]float64{}
+	for _, name := range sortedKeys(file) {
+		if reflect.DeepEqual(file[name], last[name]) {
+			continue
+		}
+		if set[name] {
+			slog.Warn("Ignoring change of config key overridden on the command line", "key", name)
+			continue
+		}
+		if _, ok := runtimeKeys[name]; !ok {
+			slog.Warn("Ignoring change of config key that cannot be applied at runtime", "key", name)
+			continue
+		}
+		values, err := flagValues(file[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %w", name, err)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("invalid value for %q: not a number", name)
+		}
+		v, err := strconv.ParseFloat(values[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %w", name, err)
+		}
+		changed[name] = v
+	}
+	for _, name := range sortedKeys(last) {
+		if _, ok := file[name]; !ok {
+			slog.Warn("Ignoring removal of config key, the last value stays in effect", "key", name)
+		}
+	}
+	ps := make([]sim.Params, len(ts))
+	for i, t := range ts {
+		ps[i] = t.sim.Params()
+		for name, v := range changed {
+			runtimeKeys[name](&ps[i], v)
+		}
+		if err := ps[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range sortedKeys(file) {
+		if v, ok := changed[name]; ok {
+			slog.Info("Config changed", "key", name, "old", last[name], "new", v)
+		}
+	}
+	for i, t := range ts {
+		if err := t.sim.SetParams(ps[i]); err != nil {
+			// Only possible for the error rate.
+			slog.Warn("Cannot apply config change", "addr", t.addr, "err", err)
+		}
+	}
+	return file, nil
+}
+
+// flagValues returns the flag values for the given YAML value. A list results
+// in one value per element, a mapping in one name=value pair per entry, sorted
+// by name.
+func flagValues(v any) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, errors.New("value missing")
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			ev, err := flagValues(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(ev) != 1 {
+				return nil, errors.New("nested lists and mappings are not supported")
+			}
+			values = append(values, ev[0])
+		}
+		return values, nil
+	case map[string]any:
+		values := make([]string, 0, len(v))
+		for name, e := range v {
+			ev, err := flagValues(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(ev) != 1 {
+				return nil, errors.New("nested lists and mappings are not supported")
+			}
+			values = append(values, name+"="+ev[0])
+		}
+		sort.Strings(values)
+		return values, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
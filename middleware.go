@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockedRand is a random number generator safe for concurrent use, as needed
+// by the middlewares serving concurrent scrapes.
+type lockedRand struct {
+	mtx sync.Mutex
+	rng *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rng.Float64()
+}
+
+func (r *lockedRand) ExpFloat64() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rng.ExpFloat64()
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rng.Int63n(n)
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rng.Intn(n)
+}
+
+// delayHandler delays a fraction of the requests to next by delay plus a
+// random duration of up to jitter, as decided by rng.
+func delayHandler(next http.Handler, rng *lockedRand, delay, jitter time.Duration, probability float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng.Float64() < probability {
+			d := delay
+			if jitter > 0 {
+				d += time.Duration(rng.Int63n(int64(jitter)))
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				// The scraper has given up, so don't bother.
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorHandler responds to a fraction of the requests, as decided by rng, with
+// the given HTTP status code instead of calling next.
+func errorHandler(next http.Handler, rng *lockedRand, rate float64, code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng.Float64() < rate {
+			slog.Debug("Injecting HTTP error into scrape", "code", code, "remote_addr", r.RemoteAddr)
+			http.Error(w, "simulated scrape error", code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corruptions are the ways corruptHandler mangles a text exposition. Each
+// takes the index of the newline ending the first sample line.
+var corruptions = []struct {
+	name string
+	f    func(b []byte, eol int) []byte
+}{
+	{"duplicate series", func(b []byte, eol int) []byte {
+		start := bytes.LastIndexByte(b[:eol], '\n') + 1
+		return slices.Insert(b, eol+1, bytes.Clone(b[start:eol+1])...)
+	}},
+	{"missing newline", func(b []byte, eol int) []byte {
+		return slices.Delete(b, eol, eol+1)
+	}},
+	{"invalid metric name", func(b []byte, eol int) []byte {
+		return slices.Insert(b, eol+1, []byte("0rrsim-corrupt 1\n")...)
+	}},
+}
+
+// corruptHandler mangles the responses to a fraction of the requests to next,
+// so that they fail to parse. A text exposition gets one of corruptions, any
+// other (protobuf or compressed) response is cut off in the middle instead.
+// Both the requests and the corruptions are picked by rng.
+func corruptHandler(next http.Handler, rng *lockedRand, rate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng.Float64() >= rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Try to get an uncompressed response to mangle.
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		b := rec.body.Bytes()
+		corruption := "truncation"
+		text := strings.HasPrefix(rec.header.Get("Content-Type"), "text/plain") ||
+			strings.HasPrefix(rec.header.Get("Content-Type"), "application/openmetrics-text")
+		if eol := firstSampleEnd(b); text && rec.header.Get("Content-Encoding") == "" && eol >= 0 {
+			c := corruptions[rng.Intn(len(corruptions))]
+			corruption, b = c.name, c.f(b, eol)
+		} else {
+			b = b[:len(b)/2]
+		}
+		slog.Debug("Corrupting scrape", "corruption", corruption, "remote_addr", r.RemoteAddr)
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.code)
+		w.Write(b)
+	})
+}
+
+// firstSampleEnd returns the index of the newline ending the first line of b
+// that is not a comment, or -1 if there is none.
+func firstSampleEnd(b []byte) int {
+	for start := 0; start < len(b); {
+		eol := bytes.IndexByte(b[start:], '\n')
+		if eol < 0 {
+			return -1
+		}
+		if b[start] != '#' {
+			return start + eol
+		}
+		start += eol + 1
+	}
+	return -1
+}
+
+// basicAuthHandler only calls next for requests with the given basic-auth
+// credentials and responds with HTTP 401 to all others.
+func basicAuthHandler(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// Evaluate both comparisons to not leak which one failed.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rrsim"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// firstByteDelayHandler calls next right away but holds back its response for
+// a random duration (picked by rng) of up to maxDelay, so that the response
+// arrives later than the gathered values were current.
+func firstByteDelayHandler(next http.Handler, rng *lockedRand, maxDelay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		t := time.NewTimer(time.Duration(rng.Int63n(int64(maxDelay))))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.code)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// scrapeLogHandler logs the requests to next along with their responses, each
+// with the given probability, as decided by rng.
+func scrapeLogHandler(next http.Handler, rng *lockedRand, sample float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng.Float64() >= sample {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &loggedResponse{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.Info("Scrape",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"accept", r.Header.Get("Accept"),
+			"accept_encoding", r.Header.Get("Accept-Encoding"),
+			"status", rec.code,
+			"content_type", rec.Header().Get("Content-Type"),
+			"content_encoding", rec.Header().Get("Content-Encoding"),
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// loggedResponse is an http.ResponseWriter recording the status code and the
+// size of the response for scrapeLogHandler.
+type loggedResponse struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (l *loggedResponse) WriteHeader(code int) {
+	l.code = code
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *loggedResponse) Write(p []byte) (int, error) {
+	n, err := l.ResponseWriter.Write(p)
+	l.bytes += n
+	return n, err
+}
+
+// bufferedResponse is an http.ResponseWriter keeping the whole response in
+// memory.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(code int)        { b.code = code }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	h := basicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}), "prom", "secret")
+	for _, tc := range []struct {
+		name           string
+		user, password string
+		noAuth         bool
+		want           int
+	}{
+		{name: "valid", user: "prom", password: "secret", want: http.StatusOK},
+		{name: "wrong password", user: "prom", password: "public", want: http.StatusUnauthorized},
+		{name: "wrong user", user: "grafana", password: "secret", want: http.StatusUnauthorized},
+		{name: "no credentials", noAuth: true, want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if !tc.noAuth {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.want)
+			}
+			challenge := rec.Header().Get("WWW-Authenticate")
+			if tc.want == http.StatusUnauthorized && challenge != `Basic realm="rrsim"` {
+				t.Errorf("got WWW-Authenticate %q", challenge)
+			}
+			if tc.want == http.StatusOK && rec.Body.String() != "metrics" {
+				t.Errorf("got body %q", rec.Body.String())
+			}
+		})
+	}
+}
@@ -1,25 +1,95 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"math/rand"
+	"html"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/beorn7/rrsim/sim"
 )
 
+// version and revision are set via -ldflags "-X main.version=... -X
+// main.revision=...". If they are not, buildInfo falls back to what the Go
+// toolchain has recorded in the binary.
 var (
+	version  string
+	revision string
+)
+
+var (
+	showVersion = flag.Bool(
+		"version", false,
+		"Print the version of rrsim and exit.",
+	)
+	configFile = flag.String(
+		"config", "",
+		"Path to a YAML file with flag names as keys, setting all flags not set on the command line. On SIGHUP, changes of qps, jitter, loss, and error-rate are applied at runtime. Lists are joined with commas, except for label, which may also be given as a mapping of label names to values.",
+	)
 	num = flag.Int(
 		"n", 20,
 		"Number of tasks per batch.",
 	)
+	immortal = flag.Int(
+		"immortal", 0,
+		"Number of tasks (the ones with the lowest ids) that are never restarted and keep running in the initial batch.",
+	)
 	restartDuration = flag.Duration(
 		"restart-duration", time.Minute,
 		"Duration of a rolling restart.",
 	)
+	strategy = flag.String(
+		"strategy", sim.StrategyRolling,
+		"How a restart batch replaces the running tasks. One of: [rolling, blue-green] (the latter starts the whole new batch at once and stops the old batch after -bg-overlap)",
+	)
+	prestart = flag.String(
+		"prestart", sim.PrestartStaggered,
+		"How the simulation starts. One of: [staggered, uniform, none] (staggered starts with tasks that have been running for a while, each until the first restart replaces it, uniform starts with fresh tasks all expected to live for -run-duration and replaced at once by the first restart, none starts without tasks until the first restart)",
+	)
+	restartOverlap = flag.Duration(
+		"restart-overlap", 0,
+		"How long a task keeps running in a rolling restart after its successor has started. If zero, it stops right before its successor starts (but still overlaps while draining, see -drain).",
+	)
+	restartOrder = flag.String(
+		"restart-order", sim.RestartOrderSequential,
+		"Order in which a rolling restart replaces the tasks. One of: [sequential, reverse, random] (the latter shuffles the tasks anew for each restart batch)",
+	)
+	bgOverlap = flag.Duration(
+		"bg-overlap", time.Minute,
+		"Time during which both the old and the new batch run with -strategy=blue-green.",
+	)
+	scaleEvents = flag.String(
+		"scale-events", "",
+		"Comma-separated changes of the number of tasks in the form offset:delta, e.g. 30s:+10,2m:-5, where offset is the time after the start.",
+	)
+	canaryFraction = flag.Float64(
+		"canary-fraction", 0,
+		"Relative amount of tasks restarted first as canaries in each rolling restart (0 for no canaries).",
+	)
+	canaryBake = flag.Duration(
+		"canary-bake", time.Minute,
+		"Time to wait after restarting the canaries before restarting the remaining tasks (only relevant with -canary-fraction).",
+	)
 	runDuration = flag.Duration(
 		"run-duration", time.Minute,
 		"Duration between restarts (and initial time before the first restart).",
@@ -30,83 +100,1104 @@ var (
 	)
 	jitter = flag.Float64(
 		"jitter", 0,
-		"How much the wait time between queries is randomly changed. The wait time between queries is normal-distributed with the given jitter value equaling σ/μ.",
+		"How much the wait time between queries is randomly changed. With -jitter-dist=normal, the wait time between queries is normal-distributed with the given jitter value equaling σ/μ.",
+	)
+	arrival = flag.String(
+		"arrival", sim.ArrivalNormal,
+		"Arrival process of queries. One of: [normal, poisson] (the latter ignores -jitter)",
+	)
+	jitterDist = flag.String(
+		"jitter-dist", sim.JitterNormal,
+		"Distribution of the jittered wait time between queries. One of: [normal, uniform, lognormal] (ignored with -arrival=poisson)",
 	)
 	loss = flag.Float64(
 		"loss", 0,
-		"Relative amount of lost scrapes. This is simulated by removing a counter from the exposed metrics for 1s now and then.",
+		"Probability of a lost scrape per task and -loss-check-interval. This is simulated by removing the metrics of the task for -loss-duration.",
 	)
 	addr = flag.String(
 		"addr", ":8080",
 		"The address to bind to (for exposition of the /metric HTTP endpoint).",
 	)
+	adminAddr = flag.String(
+		"admin-addr", "",
+		"If set, serve the admin endpoints (/-/* and /debug/pprof/*) on this address rather than on -addr. With multiple -targets, the ports count up as for -addr.",
+	)
+	targets = flag.Int(
+		"targets", 1,
+		"Number of independent simulated targets, each listening on its own port, counting up from the port in -addr.",
+	)
+	targetFlapRate = flag.Float64(
+		"target-flap-rate", 0,
+		"Average number of times per minute each target stops listening for a while (0 to never flap).",
+	)
+	targetDownMin = flag.Duration(
+		"target-down-min", 10*time.Second,
+		"Minimum time a flapping target stays down.",
+	)
+	targetDownMax = flag.Duration(
+		"target-down-max", time.Minute,
+		"Maximum time a flapping target stays down.",
+	)
+	enablePprof = flag.Bool(
+		"pprof", false,
+		"Expose the profiling endpoints of the Go runtime under /debug/pprof/.",
+	)
+	sdPath = flag.String(
+		"sd-path", "/sd",
+		"The HTTP path under which the live targets are listed in the format of the Prometheus HTTP service discovery.",
+	)
+	sdFile = flag.String(
+		"sd-file", "",
+		"If set, write the live targets to this JSON file in the format of the Prometheus file-based service discovery, rewriting it whenever they change. Targets listening on all interfaces are listed as localhost.",
+	)
+	metricsPath = flag.String(
+		"metrics-path", "/metrics",
+		"The HTTP path under which the metrics are exposed.",
+	)
+	healthyPath = flag.String(
+		"healthy-path", "/-/healthy",
+		"The HTTP path of the liveness endpoint.",
+	)
+	readyPath = flag.String(
+		"ready-path", "/-/ready",
+		"The HTTP path of the readiness endpoint, which reports ready once the first batch of tasks is running and until shutdown starts.",
+	)
+	metricName = flag.String(
+		"metric-name", "queries_total",
+		"Name of the query counter.",
+	)
+	model = flag.String(
+		"model", sim.ModelThreads,
+		"How the tasks are presented in the exposition. One of: [threads, process] (the latter adds an instance label with a host:port derived from the task id to all metrics of a task, as if each task was a separate process; Prometheus renames it to exported_instance unless honor_labels is set)",
+	)
+	utf8Names = flag.Bool(
+		"utf8-names", false,
+		"Allow any UTF-8 string in -metric-name, -metric-namespace, -metric-subsystem, and the label names (of -label, -batch-label, and -task-label), e.g. with dots. Such names are exposed quoted to scrapes asking for escaping=allow-utf-8 and escaped to all others.",
+	)
+	metricHelp = flag.String(
+		"metric-help", "Number of (simulated) queries the task has served.",
+		"Help text of the query counter.",
+	)
+	metricUnit = flag.String(
+		"metric-unit", "",
+		"Unit of the query counter, e.g. seconds, exposed in the OpenMetrics format (requires -enable-openmetrics). The name of the query counter has to end in it (before _total), e.g. -metric-name=query_time_seconds_total.",
+	)
+	metricNamespace = flag.String(
+		"metric-namespace", "",
+		"Namespace prepended to the name of the query counter.",
+	)
+	metricSubsystem = flag.String(
+		"metric-subsystem", "",
+		"Subsystem prepended to the name of the query counter (after the namespace).",
+	)
+	batchLabel = flag.String(
+		"batch-label", "batch",
+		"Name of the label identifying the restart batch of a task.",
+	)
+	taskLabel = flag.String(
+		"task-label", "task",
+		"Name of the label identifying a task within its batch.",
+	)
+	taskInfo = flag.Bool(
+		"task-info", false,
+		"Also expose an info metric task_info per task with the labels version, zone, and commit.",
+	)
+	taskInfoVersion = flag.String(
+		"task-info-version", "v1",
+		"Version of the tasks, exposed as the version label of task_info (and of the query counter with -version-label).",
+	)
+	taskInfoZones = flag.String(
+		"task-info-zones", "zone-a,zone-b,zone-c",
+		"Comma-separated values of the zone label of task_info, assigned to the tasks round-robin.",
+	)
+	versionRollout = flag.Bool(
+		"version-rollout", false,
+		"Give each restart batch a new version, counting up the last number in -task-info-version.",
+	)
+	versionLabel = flag.Bool(
+		"version-label", false,
+		"Add the version of the task as a label to the query counter.",
+	)
+	extraCounters = flag.Int(
+		"extra-counters", 0,
+		"Number of additional counters (bytes_total, requests_total, ...) per task, each increasing by its own amount with each query.",
+	)
+	churn = flag.Bool(
+		"churn", false,
+		"Also expose a counter path_requests_total per task whose path label values change over time.",
+	)
+	churnCardinality = flag.Int(
+		"churn-cardinality", 100,
+		"Number of path label values in use at any time (only relevant with -churn).",
+	)
+	churnTTL = flag.Duration(
+		"churn-ttl", 5*time.Minute,
+		"Time after which a path label value is replaced and its series is deleted once not incremented anymore (only relevant with -churn).",
+	)
+	histogram = flag.Bool(
+		"histogram", false,
+		"Also expose a histogram of (simulated) query latencies per task.",
+	)
+	summary = flag.Bool(
+		"summary", false,
+		"Expose a summary of (simulated) query latencies per task instead of a histogram.",
+	)
+	summaryObjectives = flag.String(
+		"summary-objectives", "0.5:0.05,0.9:0.01,0.99:0.001",
+		"Comma-separated quantile:error pairs of the latency summary objectives.",
+	)
+	latencyMean = flag.Float64(
+		"latency-mean", 0.05,
+		"Mean of the exponentially distributed simulated query latency in seconds.",
+	)
+	histogramBuckets = flag.String(
+		"histogram-buckets", "",
+		"Comma-separated upper bounds of the latency histogram buckets. If empty, the default buckets of the Prometheus client library are used.",
+	)
+	nativeHistogram = flag.Bool(
+		"native-histogram", false,
+		"Expose the latency histogram as a native histogram (in addition to the classic buckets). Implies -histogram.",
+	)
+	nativeHistogramOnly = flag.Bool(
+		"native-histogram-only", false,
+		"Expose the latency histogram as a native histogram without classic buckets. Implies -native-histogram.",
+	)
+	nativeHistogramBucketFactor = flag.Float64(
+		"native-histogram-bucket-factor", 1.1,
+		"Maximum factor between the boundaries of adjacent native histogram buckets.",
+	)
+	nativeHistogramMaxBuckets = flag.Uint(
+		"native-histogram-max-buckets", 160,
+		"Maximum number of native histogram buckets (0 for no limit).",
+	)
+	gauge = flag.Bool(
+		"gauge", false,
+		"Also expose a gauge of (simulated) in-flight queries per task.",
+	)
+	serviceTime = flag.Duration(
+		"service-time", 100*time.Millisecond,
+		"Mean of the exponentially distributed time a simulated query is in flight (only relevant with -gauge).",
+	)
+	uptime = flag.Bool(
+		"uptime", false,
+		"Also expose a gauge of the time since the start per task.",
+	)
+	scrapeDelay = flag.Duration(
+		"scrape-delay", 0,
+		"Delay of responses to scrapes of the metrics endpoint.",
+	)
+	scrapeDelayJitter = flag.Duration(
+		"scrape-delay-jitter", 0,
+		"Maximum additional random delay of responses to scrapes of the metrics endpoint.",
+	)
+	scrapeDelayProbability = flag.Float64(
+		"scrape-delay-probability", 1,
+		"Relative amount of scrapes that are delayed (only relevant with -scrape-delay or -scrape-delay-jitter).",
+	)
+	jitterScrapeResponse = flag.Duration(
+		"jitter-scrape-response", 0,
+		"Maximum random delay of the first byte of each response of the metrics endpoint. Unlike -scrape-delay-jitter, the metrics are gathered before the delay. Should be well below the scrape interval.",
+	)
+	scrapeErrorRate = flag.Float64(
+		"scrape-error-rate", 0,
+		"Relative amount of scrapes of the metrics endpoint that are responded to with an HTTP error.",
+	)
+	corruptRate = flag.Float64(
+		"corrupt-rate", 0,
+		"Relative amount of scrapes of the metrics endpoint that are responded to with a malformed exposition (a duplicate series, a missing newline, or an invalid metric name, or a truncated response if the exposition is not text).",
+	)
+	scrapeErrorCode = flag.Int(
+		"scrape-error-code", http.StatusInternalServerError,
+		"HTTP status code of the responses to failed scrapes (only relevant with -scrape-error-rate).",
+	)
+	tlsCert = flag.String(
+		"tls-cert", "",
+		"Path to the TLS certificate file. If set together with -tls-key, the metrics endpoint is served via HTTPS.",
+	)
+	tlsKey = flag.String(
+		"tls-key", "",
+		"Path to the TLS private key file.",
+	)
+	tlsClientCA = flag.String(
+		"tls-client-ca", "",
+		"Path to a file with CA certificates to verify client certificates with. If set, clients are required to present a valid certificate.",
+	)
+	basicAuthUser = flag.String(
+		"basic-auth-user", "",
+		"User name required to access the metrics endpoint via HTTP basic auth. If neither this nor -basic-auth-password is set, no authentication is required.",
+	)
+	basicAuthPassword = flag.String(
+		"basic-auth-password", "",
+		"Password required to access the metrics endpoint via HTTP basic auth.",
+	)
+	logLevel = flag.String(
+		"log-level", "info",
+		"Only log messages with the given severity or above. One of: [debug, info, warn, error]",
+	)
+	logFormat = flag.String(
+		"log-format", "text",
+		"Output format of log messages. One of: [text, json]",
+	)
+	logScrapes = flag.Bool(
+		"log-scrapes", false,
+		"Log each scrape of the metrics endpoint with the negotiated format and compression, the response status and size, and the duration.",
+	)
+	logScrapesSample = flag.Float64(
+		"log-scrapes-sample", 1,
+		"Relative amount of scrapes logged (only relevant with -log-scrapes).",
+	)
+	shutdownTimeout = flag.Duration(
+		"shutdown-timeout", 10*time.Second,
+		"Maximum time to wait for running tasks to stop and the HTTP server to shut down upon SIGINT or SIGTERM.",
+	)
+	workers = flag.Int(
+		"workers", 0,
+		"Number of goroutines simulating all the tasks. If not positive, GOMAXPROCS is used.",
+	)
+	seed = flag.Int64(
+		"seed", 0,
+		"Seed for all randomness of the simulation. Runs with the same non-zero seed and identical flags produce identical query timings and loss events. If 0, the current time is used.",
+	)
+	specialFloats = flag.Bool(
+		"special-floats", false,
+		"Also expose a gauge debug_value per task that is now and then NaN, +Inf, or -Inf. Meant for testing how downstream systems handle special float values.",
+	)
+	specialFloatRate = flag.Float64(
+		"special-float-rate", 0.1,
+		"Probability per second of debug_value being set to a special float value (only relevant with -special-floats).",
+	)
+	memGrowth = flag.Float64(
+		"mem-growth", 0,
+		"If positive, also expose a gauge task_resident_memory_bytes per task that grows by this many bytes per second until the task restarts, like a memory leak.",
+	)
+	memBaseline = flag.Float64(
+		"mem-baseline", 64<<20,
+		"Resident memory in bytes of a freshly started task (only relevant with -mem-growth).",
+	)
+	randomWalk = flag.Bool(
+		"random-walk", false,
+		"Also expose a gauge temperature_celsius per task that performs a bounded random walk.",
+	)
+	randomWalkStep = flag.Float64(
+		"random-walk-step", 0.5,
+		"Maximum change of the random-walk gauge per query (only relevant with -random-walk).",
+	)
+	randomWalkMin = flag.Float64(
+		"random-walk-min", -20,
+		"Lower bound of the random-walk gauge (only relevant with -random-walk).",
+	)
+	randomWalkMax = flag.Float64(
+		"random-walk-max", 40,
+		"Upper bound of the random-walk gauge (only relevant with -random-walk).",
+	)
+	errorRate = flag.Float64(
+		"error-rate", 0,
+		"Relative amount of (simulated) queries that fail. If non-zero, queries_total gets a status label with values success and error.",
+	)
+	qpsAmplitude = flag.Float64(
+		"qps-amplitude", 0,
+		"Relative amplitude of a sinusoidal variation of the QPS over time (e.g. 0.5 for ±50%).",
+	)
+	qpsPeriod = flag.Duration(
+		"qps-period", 24*time.Hour,
+		"Period of the sinusoidal QPS variation (only relevant with non-zero -qps-amplitude).",
+	)
+	qpsRamp = flag.Float64(
+		"qps-ramp", 0,
+		"Relative change of the QPS with each restart batch (e.g. 0.2 for each batch to serve 20% more queries than the previous one), to simulate traffic shifting between batches.",
+	)
+	qpsVariance = flag.Float64(
+		"qps-variance", 0,
+		"Relative standard deviation of the QPS of individual tasks around -qps. Each task keeps its QPS for its whole lifetime.",
+	)
+	burstRate = flag.Float64(
+		"burst-rate", 0,
+		"Probability per second of a task serving a burst of queries at once.",
+	)
+	burstSize = flag.Int(
+		"burst-size", 100,
+		"Number of queries in a burst (only relevant with -burst-rate).",
+	)
+	burstSync = flag.Bool(
+		"burst-sync", false,
+		"Let all tasks burst during the same seconds (only relevant with -burst-rate).",
+	)
+	warmup = flag.Duration(
+		"warmup", 0,
+		"Time after the start of each task during which its QPS ramps up linearly from 10% to the full -qps.",
+	)
+	deterministic = flag.Bool(
+		"deterministic", false,
+		"Remove the randomness from the timing of queries (ignoring -jitter and -arrival) and spread failed queries and lost scrapes evenly rather than randomly.",
+	)
+	startPaused = flag.Bool(
+		"start-paused", false,
+		"Start the simulation paused, i.e. without serving queries and with the restart schedule suspended, until resumed via POST /-/resume.",
+	)
+	maxQueries = flag.Int(
+		"max-queries", 0,
+		"If positive, each task stops serving queries after that many, keeping its metrics at their final values until it stops.",
+	)
+	drain = flag.Duration(
+		"drain", 0,
+		"Time before a task is replaced by its successor or scaled down during which its QPS ramps down linearly to zero. The draining task overlaps with its successor unless -preserve-on-restart is set.",
+	)
+	spuriousResetRate = flag.Float64(
+		"spurious-reset-rate", 0,
+		"Probability per second and task to decrease the query counter to a random lower value without restarting the task.",
+	)
+	roleFlipRate = flag.Float64(
+		"role-flip-rate", 0,
+		"Probability per second and task to flip the role label of the query counter to another one of -roles, so that the counter continues as a new series. If zero, there is no role label.",
+	)
+	roles = flag.String(
+		"roles", "leader,follower",
+		"Comma-separated values of the role label (only relevant with -role-flip-rate).",
+	)
+	increment = flag.Float64(
+		"increment", 1,
+		"Amount each query adds to the query counter. Non-integer values result in float-valued counters.",
+	)
+	incrementJitter = flag.Float64(
+		"increment-jitter", 0,
+		"Add a uniformly distributed random amount between -x and +x to each increment. Must be less than -increment to keep the counter increasing.",
+	)
+	counterStart = flag.Float64(
+		"counter-start", 0,
+		"Initial value of the query counter of each task. Note that a restart still looks like a counter reset unless -preserve-on-restart is set.",
+	)
+	counterStartMax = flag.Float64(
+		"counter-start-max", 0,
+		"If positive, start the query counter of each task at a random integer between 0 and this value instead of -counter-start.",
+	)
+	preserveOnRestart = flag.Bool(
+		"preserve-on-restart", false,
+		"Start the counter of a restarted task with the final value of the most recently stopped task with the same id, so that the restart does not look like a counter reset.",
+	)
+	explicitStaleness = flag.Bool(
+		"explicit-staleness", false,
+		"Keep the counters and gauges of a stopped task in the exposition for one more scrape with a stale marker as value. Only effective with the protobuf exposition format, as the text formats cannot represent stale markers.",
+	)
+	batchPaths = flag.Bool(
+		"batch-paths", false,
+		"Also expose the metrics of each restart batch with running tasks under <metrics-path>/batch/<n>, with each batch in a registry of its own. The metrics path still exposes all of them.",
+	)
+	paddingSeries = flag.Int(
+		"padding-series", 0,
+		"Number of rrsim_padding gauges with long label values added to the exposition to inflate its size.",
+	)
+	targetScrapeSize = flag.Int(
+		"target-scrape-size", 0,
+		"Alternative to -padding-series: the approximate number of bytes the padding series are to add to the text exposition.",
+	)
+	includeGoMetrics = flag.Bool(
+		"include-go-metrics", false,
+		"Also expose the Go runtime and process metrics of the simulator itself.",
+	)
+	instrumentHandler = flag.Bool(
+		"instrument-handler", false,
+		"Also expose the promhttp_metric_handler_* metrics about the scrapes of the metrics endpoint.",
+	)
+	defaultFormat = flag.String(
+		"default-format", sim.FormatText,
+		"Exposition format used for scrapes that do not ask for a specific one in their Accept header. One of: [text, openmetrics, protobuf] (openmetrics requires -enable-openmetrics)",
+	)
+	enableOpenMetrics = flag.Bool(
+		"enable-openmetrics", false,
+		"Expose metrics in the OpenMetrics format if requested by the scraper, with the units of the metrics that have one in their name.",
+	)
+	enableOpenMetricsCreated = flag.Bool(
+		"enable-openmetrics-created", false,
+		"Add _created samples to the OpenMetrics exposition (only relevant with -enable-openmetrics).",
+	)
+	forceGzip = flag.Bool(
+		"force-gzip", false,
+		"Gzip-compress all responses of the metrics endpoint, even if the scraper does not accept that encoding.",
+	)
+	noGzip = flag.Bool(
+		"no-gzip", false,
+		"Never compress responses of the metrics endpoint, even if the scraper accepts a compressed encoding.",
+	)
+	exemplars = flag.Bool(
+		"exemplars", false,
+		"Attach exemplars with a random trace_id to the increments of queries_total (only relevant with -enable-openmetrics).",
+	)
+	exemplarRate = flag.Float64(
+		"exemplar-rate", 1,
+		"Relative amount of increments of queries_total an exemplar is attached to (only relevant with -exemplars).",
+	)
+	timestampSkew = flag.Duration(
+		"timestamp-skew", 0,
+		"If non-zero, expose all samples of the simulated tasks with an explicit timestamp offset by that much from the current time. May be negative.",
+	)
+	outOfOrderRate = flag.Float64(
+		"out-of-order-rate", 0,
+		"Probability per scrape and task to expose queries_total with a timestamp -out-of-order-age in the past. Prometheus only ingests those samples with honor_timestamps: true.",
+	)
+	outOfOrderAge = flag.Duration(
+		"out-of-order-age", time.Minute,
+		"How far in the past to timestamp out-of-order samples (see -out-of-order-rate). Should be a few scrape intervals.",
+	)
+	lossCheckInterval = flag.Duration(
+		"loss-check-interval", time.Second,
+		"How often to decide, with the probability given by -loss, whether to lose the metrics of a task.",
+	)
+	lossDuration = flag.Duration(
+		"loss-duration", time.Second,
+		"How long lost metrics stay gone.",
+	)
+	correlatedLoss = flag.Bool(
+		"correlated-loss", false,
+		"Simulate -loss by failing whole scrapes rather than removing the metrics of individual tasks.",
+	)
+	partialLoss = flag.Bool(
+		"partial-loss", false,
+		"Simulate partially lost scrapes by dropping random metric families from each scrape.",
+	)
+	partialLossFraction = flag.Float64(
+		"partial-loss-fraction", 0.1,
+		"Relative amount of metric families dropped from each scrape (only relevant with -partial-loss).",
+	)
+	pushgateway = flag.String(
+		"pushgateway", "",
+		"URL of a Pushgateway to push the metrics of each task to (in addition to exposing them).",
+	)
+	pushInterval = flag.Duration(
+		"push-interval", 15*time.Second,
+		"Interval between pushes to the Pushgateway (only relevant with -pushgateway).",
+	)
+	job = flag.String(
+		"job", "rrsim",
+		"Job name used for pushes to the Pushgateway and as job label for remote write (only relevant with -pushgateway or -remote-write-url).",
+	)
+	pushDeleteOnStop = flag.Bool(
+		"push-delete-on-stop", false,
+		"Delete the pushed metrics of a task from the Pushgateway when the task stops (only relevant with -pushgateway).",
+	)
+	remoteWriteURL = flag.String(
+		"remote-write-url", "",
+		"URL of a remote-write receiver to send the metrics to (in addition to exposing them).",
+	)
+	remoteWriteInterval = flag.Duration(
+		"remote-write-interval", 15*time.Second,
+		"Interval between remote writes (only relevant with -remote-write-url).",
+	)
+	crashRate = flag.Float64(
+		"crash-rate", 0,
+		"Relative amount of tasks that crash at a random time during their lifetime instead of running until they are restarted.",
+	)
+	crashHang = flag.Duration(
+		"crash-hang", 0,
+		"Time a crashing task keeps exposing its frozen metrics before it is gone (only relevant with -crash-rate).",
+	)
+	stuckRate = flag.Float64(
+		"stuck-rate", 0,
+		"Relative amount of tasks that get stuck at a random time during their lifetime, i.e. stop serving queries but keep exposing their metrics until they are restarted.",
+	)
+	maxRestarts = flag.Int(
+		"max-restarts", 0,
+		"If positive, exit after that many restart batches once all tasks have stopped.",
+	)
+	maxDuration = flag.Duration(
+		"max-duration", 0,
+		"If positive, stop all tasks and exit after that much time.",
+	)
+	dryRun = flag.Bool(
+		"dry-run", false,
+		"Print the planned starts and stops of the tasks to stdout and exit without running the simulation. Scale events, crashes, and restarts triggered via the admin endpoint are not taken into account.",
+	)
+	dryRunBatches = flag.Int(
+		"dry-run-batches", 3,
+		"Number of restart batches printed by -dry-run (at most -max-restarts if that is positive).",
+	)
+
+	labels          = labelsFlag{}
+	otherMetricHelp = labelsFlag{}
 )
 
-func waitDurationNs() float64 {
-	return 1e9 * (rand.NormFloat64()**jitter + 1) / *qps
-}
-
-func runTask(id, batch int, duration time.Duration) {
-	log.Printf("Starting task %d of batch %d.\n", id, batch)
-	defer log.Printf("Stopping task %d of batch %d.\n", id, batch)
-
-	cnt := prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "queries_total",
-		Help: "Number of (simulated) queries the task has served.",
-		ConstLabels: prometheus.Labels{
-			"batch": fmt.Sprint(batch),
-			"task":  fmt.Sprint(id),
-		},
-	})
-	prometheus.MustRegister(cnt)
-	defer prometheus.Unregister(cnt)
-	registered := true
-
-	stopTimer := time.NewTimer(duration)
-	queryTimer := time.NewTimer(time.Duration(waitDurationNs() * rand.Float64()))
-	lossTicker := time.NewTicker(time.Second)
-	defer lossTicker.Stop()
-
-	for {
-		select {
-		case <-stopTimer.C:
-			return
-		case <-queryTimer.C:
-			cnt.Inc()
-			queryTimer.Reset(time.Duration(waitDurationNs()))
-		case <-lossTicker.C:
-			if rand.Float64() < *loss && registered {
-				prometheus.Unregister(cnt)
-				registered = false
-			} else if !registered {
-				prometheus.MustRegister(cnt)
-				registered = true
+// parseBuckets parses a comma-separated list of bucket upper bounds.
+func parseBuckets(s string) ([]float64, error) {
+	var b []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", f, err)
+		}
+		if len(b) > 0 && v <= b[len(b)-1] {
+			return nil, fmt.Errorf("buckets not in increasing order at %q", f)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// parseScaleEvents parses a comma-separated list of scale events in the form
+// offset:delta, e.g. 30s:+10.
+func parseScaleEvents(s string) ([]sim.ScaleEvent, error) {
+	var events []sim.ScaleEvent
+	for _, f := range strings.Split(s, ",") {
+		at, delta, ok := strings.Cut(strings.TrimSpace(f), ":")
+		if !ok {
+			return nil, fmt.Errorf("scale event %q not in the form offset:delta", f)
+		}
+		var (
+			e   sim.ScaleEvent
+			err error
+		)
+		if e.At, err = time.ParseDuration(at); err != nil {
+			return nil, fmt.Errorf("invalid offset %q: %v", at, err)
+		}
+		if e.Delta, err = strconv.Atoi(delta); err != nil {
+			return nil, fmt.Errorf("invalid delta %q: %v", delta, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// parseObjectives parses a comma-separated list of quantile:error pairs.
+func parseObjectives(s string) (map[float64]float64, error) {
+	o := map[float64]float64{}
+	for _, f := range strings.Split(s, ",") {
+		qs, es, ok := strings.Cut(strings.TrimSpace(f), ":")
+		if !ok {
+			return nil, fmt.Errorf("objective %q not in the form quantile:error", f)
+		}
+		q, err := strconv.ParseFloat(qs, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantile %q: %v", qs, err)
+		}
+		e, err := strconv.ParseFloat(es, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error %q: %v", es, err)
+		}
+		if _, dup := o[q]; dup {
+			return nil, fmt.Errorf("duplicate quantile %v", q)
+		}
+		o[q] = e
+	}
+	return o, nil
+}
+
+func init() {
+	flag.Var(
+		labels, "label",
+		"Additional const label added to all metrics of the simulated tasks, in the form name=value. May be repeated.",
+	)
+	flag.Var(
+		otherMetricHelp, "other-metric-help",
+		"Help text of a metric of the simulated tasks other than the query counter, in the form name=text, where name is the metric name without namespace and subsystem, e.g. query_duration_seconds=Latency. May be repeated.",
+	)
+}
+
+// labelsFlag is a flag.Value collecting name=value pairs.
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelsFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form name=value", s)
+	}
+	if _, dup := f[name]; dup {
+		return fmt.Errorf("duplicate name %q", name)
+	}
+	f[name] = value
+	return nil
+}
+
+// checkPath returns an error if p is not usable as the path of an HTTP
+// endpoint.
+func checkPath(p string) error {
+	if !strings.HasPrefix(p, "/") || p == "/" {
+		return fmt.Errorf("path %q does not start with a / followed by at least one character", p)
+	}
+	if u, err := url.Parse(p); err != nil || u.Path != p {
+		return fmt.Errorf("%q is not a plain URL path", p)
+	}
+	return nil
+}
+
+// printSchedule prints events as a table to w.
+func printSchedule(w io.Writer, events []sim.ScheduleEvent) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tBATCH\tTASK\tEVENT")
+	for _, e := range events {
+		task, event := strconv.Itoa(e.Task), "stop"
+		switch {
+		case e.Task < 0:
+			task, event = "", "restart batch"
+		case e.Start:
+			event = "start"
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%s\t%s\n", e.At, e.Batch, task, event)
+	}
+	return tw.Flush()
+}
+
+// rootHandler serves a minimal landing page linking to the metrics.
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `<html>
+<head><title>rrsim</title></head>
+<body>
+<h1>rrsim</h1>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
+`, html.EscapeString(*metricsPath))
+}
+
+// tlsConfig returns the TLS configuration as set by the flags, or nil if TLS is
+// not configured.
+func tlsConfig() (*tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsClientCA != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, errors.New("-tls-cert and -tls-key have to be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsClientCA != "" {
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// setupLogging configures the default logger as set by the flags.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch *logFormat {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// config returns the simulator configuration as set by the flags.
+func config() sim.Config {
+	v, rev := buildInfo()
+	cfg := sim.Config{
+		Num:                            *num,
+		Immortal:                       *immortal,
+		RestartDuration:                *restartDuration,
+		Strategy:                       *strategy,
+		RestartOrder:                   *restartOrder,
+		RestartOverlap:                 *restartOverlap,
+		Prestart:                       *prestart,
+		BGOverlap:                      *bgOverlap,
+		CanaryFraction:                 *canaryFraction,
+		CanaryBake:                     *canaryBake,
+		RunDuration:                    *runDuration,
+		QPS:                            *qps,
+		Jitter:                         *jitter,
+		Arrival:                        *arrival,
+		JitterDist:                     *jitterDist,
+		Loss:                           *loss,
+		LossCheckInterval:              *lossCheckInterval,
+		LossDuration:                   *lossDuration,
+		CorrelatedLoss:                 *correlatedLoss,
+		QPSAmplitude:                   *qpsAmplitude,
+		QPSPeriod:                      *qpsPeriod,
+		QPSRamp:                        *qpsRamp,
+		QPSVariance:                    *qpsVariance,
+		Warmup:                         *warmup,
+		Deterministic:                  *deterministic,
+		StartPaused:                    *startPaused,
+		MaxQueries:                     *maxQueries,
+		Drain:                          *drain,
+		BurstRate:                      *burstRate,
+		BurstSize:                      *burstSize,
+		BurstSync:                      *burstSync,
+		MetricName:                     *metricName,
+		MetricNamespace:                *metricNamespace,
+		MetricHelp:                     *metricHelp,
+		UTF8Names:                      *utf8Names,
+		Model:                          *model,
+		Help:                           otherMetricHelp,
+		MetricSubsystem:                *metricSubsystem,
+		MetricUnit:                     *metricUnit,
+		Labels:                         labels,
+		BatchLabel:                     *batchLabel,
+		TaskLabel:                      *taskLabel,
+		TaskInfo:                       *taskInfo,
+		TaskInfoVersion:                *taskInfoVersion,
+		TaskInfoZones:                  strings.Split(*taskInfoZones, ","),
+		VersionRollout:                 *versionRollout,
+		VersionLabel:                   *versionLabel,
+		ExtraCounters:                  *extraCounters,
+		Churn:                          *churn,
+		ChurnCardinality:               *churnCardinality,
+		ChurnTTL:                       *churnTTL,
+		Histogram:                      *histogram,
+		NativeHistogram:                *nativeHistogram,
+		Summary:                        *summary,
+		SpecialFloats:                  *specialFloats,
+		SpecialFloatRate:               *specialFloatRate,
+		MemGrowth:                      *memGrowth,
+		MemBaseline:                    *memBaseline,
+		NativeHistogramOnly:            *nativeHistogramOnly,
+		NativeHistogramBucketFactor:    *nativeHistogramBucketFactor,
+		NativeHistogramMaxBucketNumber: uint32(*nativeHistogramMaxBuckets),
+		LatencyMean:                    *latencyMean,
+		Gauge:                          *gauge,
+		ServiceTime:                    *serviceTime,
+		Uptime:                         *uptime,
+		RandomWalk:                     *randomWalk,
+		RandomWalkStep:                 *randomWalkStep,
+		RandomWalkMin:                  *randomWalkMin,
+		RandomWalkMax:                  *randomWalkMax,
+		ErrorRate:                      *errorRate,
+		SpuriousResetRate:              *spuriousResetRate,
+		RoleFlipRate:                   *roleFlipRate,
+		Roles:                          strings.Split(*roles, ","),
+		Increment:                      *increment,
+		IncrementJitter:                *incrementJitter,
+		CounterStart:                   *counterStart,
+		CounterStartMax:                *counterStartMax,
+		PreserveOnRestart:              *preserveOnRestart,
+		ExplicitStaleness:              *explicitStaleness,
+		BatchRegistries:                *batchPaths,
+		PaddingSeries:                  *paddingSeries,
+		TargetScrapeSize:               *targetScrapeSize,
+		IncludeGoMetrics:               *includeGoMetrics,
+		InstrumentHandler:              *instrumentHandler,
+		EnableOpenMetrics:              *enableOpenMetrics,
+		DefaultFormat:                  *defaultFormat,
+		EnableOpenMetricsCreated:       *enableOpenMetricsCreated,
+		ForceGzip:                      *forceGzip,
+		DisableCompression:             *noGzip,
+		Exemplars:                      *exemplars,
+		ExemplarRate:                   *exemplarRate,
+		TimestampSkew:                  *timestampSkew,
+		OutOfOrderRate:                 *outOfOrderRate,
+		OutOfOrderAge:                  *outOfOrderAge,
+		PartialLoss:                    *partialLoss,
+		PartialLossFraction:            *partialLossFraction,
+		Pushgateway:                    *pushgateway,
+		PushInterval:                   *pushInterval,
+		Job:                            *job,
+		PushDeleteOnStop:               *pushDeleteOnStop,
+		RemoteWriteURL:                 *remoteWriteURL,
+		RemoteWriteInterval:            *remoteWriteInterval,
+		CrashRate:                      *crashRate,
+		CrashHang:                      *crashHang,
+		StuckRate:                      *stuckRate,
+		MaxRestarts:                    *maxRestarts,
+		MaxDuration:                    *maxDuration,
+		ShutdownTimeout:                *shutdownTimeout,
+		Workers:                        *workers,
+		Version:                        v,
+		Revision:                       rev,
+		Seed:                           *seed,
+	}
+	if *histogramBuckets != "" {
+		var err error
+		if cfg.HistogramBuckets, err = parseBuckets(*histogramBuckets); err != nil {
+			fatal("Invalid -histogram-buckets", "err", err)
+		}
+	}
+	if *scaleEvents != "" {
+		var err error
+		if cfg.ScaleEvents, err = parseScaleEvents(*scaleEvents); err != nil {
+			fatal("Invalid -scale-events", "err", err)
+		}
+	}
+	if *summary {
+		var err error
+		if cfg.SummaryObjectives, err = parseObjectives(*summaryObjectives); err != nil {
+			fatal("Invalid -summary-objectives", "err", err)
+		}
+	}
+	return cfg
+}
+
+// buildInfo returns the version and the VCS revision of rrsim, as set via
+// -ldflags or else as recorded by the Go toolchain, and "unknown" if neither is
+// available.
+func buildInfo() (v, rev string) {
+	v, rev = version, revision
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && bi.Main.Version != "(devel)" {
+			v = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && rev == "" {
+				rev = s.Value
 			}
 		}
 	}
+	if v == "" {
+		v = "unknown"
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	return v, rev
+}
+
+// flagErrors returns an error for each numeric flag only used by main (rather
+// than in the sim.Config) that is out of its bounds.
+func flagErrors() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(*targetFlapRate >= 0, "-target-flap-rate must not be negative, got %v", *targetFlapRate)
+	check(*targetDownMin >= 0 && *targetDownMin <= *targetDownMax, "-target-down-min must be between 0 and -target-down-max (%v), got %v", *targetDownMax, *targetDownMin)
+	check(*scrapeDelay >= 0, "-scrape-delay must not be negative, got %v", *scrapeDelay)
+	check(*scrapeDelayJitter >= 0, "-scrape-delay-jitter must not be negative, got %v", *scrapeDelayJitter)
+	check(*jitterScrapeResponse >= 0, "-jitter-scrape-response must not be negative, got %v", *jitterScrapeResponse)
+	for _, r := range []struct {
+		flag string
+		r    float64
+	}{
+		{"scrape-delay-probability", *scrapeDelayProbability},
+		{"scrape-error-rate", *scrapeErrorRate},
+		{"corrupt-rate", *corruptRate},
+		{"log-scrapes-sample", *logScrapesSample},
+	} {
+		check(r.r >= 0 && r.r <= 1, "-%s must be between 0 and 1, got %v", r.flag, r.r)
+	}
+	check(*scrapeErrorCode >= 100 && *scrapeErrorCode <= 599, "-scrape-error-code must be an HTTP status code, got %d", *scrapeErrorCode)
+	check(*dryRunBatches >= 0, "-dry-run-batches must not be negative, got %d", *dryRunBatches)
+	return errs
+}
+
+// flatten returns the errors joined in err (recursively) by errors.Join, or
+// just err if it is not joined. It returns nil for a nil err.
+func flatten(err error) []error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flatten(e)...)
+	}
+	return errs
 }
 
 func main() {
 	flag.Parse()
+	if *showVersion {
+		v, rev := buildInfo()
+		fmt.Printf("rrsim, version %s (revision: %s, go version: %s)\n", v, rev, runtime.Version())
+		return
+	}
+	var file map[string]any
+	if *configFile != "" {
+		var err error
+		if file, err = loadConfigFile(*configFile); err != nil {
+			fatal("Invalid config file", "path", *configFile, "err", err)
+		}
+	}
 
-	http.Handle("/metrics", prometheus.Handler())
-	go http.ListenAndServe(*addr, nil)
+	if err := setupLogging(); err != nil {
+		fatal("Invalid logging configuration", "err", err)
+	}
+	tlsCfg, err := tlsConfig()
+	if err != nil {
+		fatal("Invalid TLS configuration", "err", err)
+	}
+	paths := map[string]string{}
+	for _, p := range []struct{ flag, path string }{
+		{"metrics-path", *metricsPath},
+		{"healthy-path", *healthyPath},
+		{"ready-path", *readyPath},
+		{"sd-path", *sdPath},
+	} {
+		if err := checkPath(p.path); err != nil {
+			fatal("Invalid -"+p.flag, "err", err)
+		}
+		if other, ok := paths[p.path]; ok {
+			fatal(fmt.Sprintf("-%s and -%s are set to the same path", other, p.flag), "path", p.path)
+		}
+		paths[p.path] = p.flag
+	}
+	addrs, err := targetAddrs(*addr, *targets)
+	if err != nil {
+		fatal("Invalid -addr or -targets", "err", err)
+	}
+	var adminAddrs []string
+	if *adminAddr != "" {
+		if adminAddrs, err = targetAddrs(*adminAddr, *targets); err != nil {
+			fatal("Invalid -admin-addr", "err", err)
+		}
+	}
+	if *sdFile != "" && filepath.Ext(*sdFile) != ".json" {
+		fatal("-sd-file must have the extension .json", "path", *sdFile)
+	}
 
-	batch := 0
+	cfg := config()
+	// Report all invalid values at once.
+	if errs := append(flagErrors(), flatten(cfg.Validate())...); len(errs) > 0 {
+		for _, err := range errs {
+			slog.Error("Invalid configuration", "err", err)
+		}
+		os.Exit(1)
+	}
+	if *dryRun {
+		if err := printSchedule(os.Stdout, sim.New(cfg).Schedule(*dryRunBatches)); err != nil {
+			fatal("Failed to print schedule", "err", err)
+		}
+		return
+	}
+	// The targets need the seed for their own randomness, too.
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	ts := make([]*target, len(addrs))
+	for i, a := range addrs {
+		tCfg := cfg
+		if len(addrs) > 1 {
+			tCfg.Logger = slog.Default().With("target", a)
+			tCfg.Seed += int64(i)
+		}
+		ts[i] = newTarget(a, tCfg, tlsCfg)
+		if adminAddrs != nil {
+			ts[i].adminAddr = adminAddrs[i]
+		}
+	}
+	sd := sdHandler(ts)
+	for _, t := range ts {
+		t.handler = newMux(t, sd, t.adminAddr != "")
+		if t.adminAddr != "" {
+			t.adminHandler = newAdminMux(t.sim)
+		}
+		t.listen()
+		t.listenAdmin()
+	}
+	slog.Info("Serving simulated targets", "addrs", addrs)
+	if adminAddrs != nil {
+		slog.Info("Serving admin endpoints", "addrs", adminAddrs)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second signal terminates the process immediately.
+		<-ctx.Done()
+		stop()
+	}()
+
+	sdFileCtx, stopSDFile := context.WithCancel(context.Background())
+	sdFileDone := make(chan struct{})
+	if *sdFile != "" {
+		scheme := "http"
+		if tlsCfg != nil {
+			scheme = "https"
+		}
+		go func() {
+			writeSDFile(sdFileCtx, *sdFile, ts, scheme)
+			close(sdFileDone)
+		}()
+	} else {
+		close(sdFileDone)
+	}
 
-	// First start one batch of already running tasks.
-	for i := 0; i < *num; i++ {
-		go runTask(i, batch, *runDuration+*restartDuration*time.Duration(i)/time.Duration(*num))
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if *configFile == "" {
+				slog.Warn("Ignoring SIGHUP as no config file has been set")
+				continue
+			}
+			slog.Info("Reloading config file", "path", *configFile)
+			f, err := reloadConfigFile(*configFile, file, ts)
+			if err != nil {
+				slog.Error("Error reloading config file, keeping the current config", "path", *configFile, "err", err)
+				continue
+			}
+			file = f
+		}
+	}()
+
+	flapCtx, stopFlapping := context.WithCancel(ctx)
+	if *targetFlapRate > 0 {
+		for _, t := range ts {
+			go t.flap(flapCtx, *targetFlapRate, *targetDownMin, *targetDownMax)
+		}
+	}
+
+	var (
+		exitCode atomic.Int32
+		wg       sync.WaitGroup
+	)
+	for _, t := range ts {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			if err := t.sim.Run(ctx); err != nil {
+				slog.Error("Simulation did not stop cleanly", "addr", t.addr, "err", err)
+				exitCode.Store(1)
+			}
+		}(t)
 	}
+	wg.Wait()
+	stopFlapping()
 
-	for {
-		time.Sleep(*runDuration)
-		batch++
-		log.Printf("Initiating restart batch %d.\n", batch)
-		for i := 0; i < *num; i++ {
-			go runTask(i, batch, *runDuration+*restartDuration)
-			time.Sleep(*restartDuration / time.Duration(*num))
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, t := range ts {
+		if err := t.shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down HTTP server", "addr", t.addr, "err", err)
+			exitCode.Store(1)
 		}
-		log.Printf("Restart batch %d complete.\n", batch)
 	}
+	cancel()
+	// Leave an SD file without any live targets behind.
+	stopSDFile()
+	<-sdFileDone
+	os.Exit(int(exitCode.Load()))
 }
@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"math/rand"
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// batchRegistry holds the metrics of the tasks of one restart batch for
+// BatchRegistries.
+type batchRegistry struct {
+	reg     *prometheus.Registry
+	handler http.Handler
+	tasks   int // Number of tasks that have not stopped yet.
+}
+
+// taskRegisterer returns the Registerer for the metrics of a task in the given
+// batch. With BatchRegistries, the task has to call releaseRegisterer once it
+// has unregistered its metrics for good.
+func (s *Simulator) taskRegisterer(batch int) prometheus.Registerer {
+	if !s.cfg.BatchRegistries {
+		return s.reg
+	}
+	s.batchRegsMtx.Lock()
+	defer s.batchRegsMtx.Unlock()
+	br, ok := s.batchRegs[batch]
+	if !ok {
+		reg := prometheus.NewRegistry()
+		var g prometheus.Gatherer = reg
+		if s.cfg.PartialLoss {
+			g = &lossyGatherer{
+				Gatherer: g,
+				fraction: s.cfg.PartialLossFraction,
+				rng:      rand.New(rand.NewSource(s.cfg.Seed + int64(batch))),
+			}
+		}
+		br = &batchRegistry{reg: reg, handler: s.handlerFor(g)}
+		s.batchRegs[batch] = br
+	}
+	br.tasks++
+	return br.reg
+}
+
+// releaseRegisterer drops the registry of the given batch once all its tasks
+// have released it. It is a no-op without BatchRegistries.
+func (s *Simulator) releaseRegisterer(batch int) {
+	if !s.cfg.BatchRegistries {
+		return
+	}
+	s.batchRegsMtx.Lock()
+	defer s.batchRegsMtx.Unlock()
+	br, ok := s.batchRegs[batch]
+	if !ok {
+		return
+	}
+	if br.tasks--; br.tasks == 0 {
+		delete(s.batchRegs, batch)
+		s.log.Debug("Dropped registry of drained batch", "batch", batch)
+	}
+}
+
+// gatherBatches gathers the metrics of all live batches along with the ones
+// that do not belong to any batch.
+func (s *Simulator) gatherBatches() ([]*dto.MetricFamily, error) {
+	s.batchRegsMtx.Lock()
+	batches := make([]int, 0, len(s.batchRegs))
+	for batch := range s.batchRegs {
+		batches = append(batches, batch)
+	}
+	slices.Sort(batches)
+	gs := prometheus.Gatherers{s.reg}
+	for _, batch := range batches {
+		gs = append(gs, s.batchRegs[batch].reg)
+	}
+	s.batchRegsMtx.Unlock()
+	return gs.Gather()
+}
+
+// BatchHandler returns an http.Handler exposing only the metrics of the tasks
+// in the given restart batch, or nil if BatchRegistries is not set or no task
+// of the batch is running. The handler keeps working after the batch has
+// drained, with all its metrics gone.
+func (s *Simulator) BatchHandler(batch int) http.Handler {
+	s.batchRegsMtx.Lock()
+	defer s.batchRegsMtx.Unlock()
+	if br, ok := s.batchRegs[batch]; ok {
+		return br.handler
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package sim
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchHandler(t *testing.T) {
+	cfg := testConfig()
+	cfg.Num = 1
+	cfg.BatchRegistries = true
+	// Keeps the initial batch around while the restart batch runs.
+	cfg.Drain = 300 * time.Millisecond
+	s := run(t, cfg)
+	if h := s.BatchHandler(1); h != nil {
+		t.Fatal("got a handler for a batch that has not started")
+	}
+	if _, err := s.Restart(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the restarted task", func() bool { return s.BatchHandler(1) != nil })
+
+	const series0, series1 = `queries_total{batch="0",task="0"}`, `queries_total{batch="1",task="0"}`
+	body := scrapeText(t, s.BatchHandler(1), "")
+	if !strings.Contains(body, series1) || strings.Contains(body, series0) {
+		t.Errorf("exposition of batch 1 does not have only its own series:\n%s", body)
+	}
+	h0 := s.BatchHandler(0)
+	if h0 == nil {
+		t.Fatal("no handler for the draining batch")
+	}
+	if body := scrapeText(t, s.Handler(), ""); !strings.Contains(body, series0) || !strings.Contains(body, series1) {
+		t.Errorf("exposition of all batches lacks the series of either batch:\n%s", body)
+	}
+
+	waitFor(t, "the initial batch to drain", func() bool { return s.BatchHandler(0) == nil })
+	// A handler obtained before keeps working, without any metrics.
+	if body := scrapeText(t, h0, ""); strings.Contains(body, "queries_total") {
+		t.Errorf("drained batch still exposes queries:\n%s", body)
+	}
+}
@@ -0,0 +1,71 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// churner maintains a CounterVec with a path label whose values rotate through
+// a pool of random strings. Series not incremented for ttl are deleted.
+type churner struct {
+	vec      *prometheus.CounterVec
+	pool     []string
+	lastUsed map[string]time.Time
+	lastTick time.Time
+	ttl      time.Duration
+	rng      *rand.Rand
+}
+
+// churnHelp is the default help text of the counter of a churner.
+const churnHelp = "Number of (simulated) requests by path, with the paths changing over time."
+
+func newChurner(labels prometheus.Labels, help string, cardinality int, ttl time.Duration, rng *rand.Rand) *churner {
+	c := &churner{
+		vec: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "path_requests_total",
+			Help:        help,
+			ConstLabels: labels,
+		}, []string{"path"}),
+		pool:     make([]string, cardinality),
+		lastUsed: map[string]time.Time{},
+		lastTick: time.Now(),
+		ttl:      ttl,
+		rng:      rng,
+	}
+	for i := range c.pool {
+		c.pool[i] = c.randomPath()
+	}
+	return c
+}
+
+func (c *churner) randomPath() string {
+	return fmt.Sprintf("/api/%08x", c.rng.Uint32())
+}
+
+// inc increments the series of a random path from the pool.
+func (c *churner) inc(now time.Time) {
+	path := c.pool[c.rng.Intn(len(c.pool))]
+	c.vec.WithLabelValues(path).Inc()
+	c.lastUsed[path] = now
+}
+
+// tick replaces pool entries with new paths, on average the whole pool per ttl,
+// and deletes the series of paths not incremented for ttl.
+func (c *churner) tick(now time.Time) {
+	n := float64(len(c.pool)) * float64(now.Sub(c.lastTick)) / float64(c.ttl)
+	c.lastTick = now
+	for ; n > 0; n-- {
+		if n >= 1 || c.rng.Float64() < n {
+			c.pool[c.rng.Intn(len(c.pool))] = c.randomPath()
+		}
+	}
+	for path, t := range c.lastUsed {
+		if now.Sub(t) >= c.ttl {
+			c.vec.DeleteLabelValues(path)
+			delete(c.lastUsed, path)
+		}
+	}
+}
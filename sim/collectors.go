@@ -0,0 +1,278 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// skewedCollector wraps a Collector and attaches an explicit timestamp, offset
+// from the current time by skew, to all the collected metrics.
+type skewedCollector struct {
+	prometheus.Collector
+	skew time.Duration
+}
+
+func (c skewedCollector) Collect(ch chan<- prometheus.Metric) {
+	ts := time.Now().Add(c.skew)
+	in := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(in)
+		close(in)
+	}()
+	for m := range in {
+		ch <- prometheus.NewMetricWithTimestamp(ts, m)
+	}
+}
+
+// outOfOrderCollector wraps a Collector and, with probability rate per
+// collection, attaches a timestamp age in the past to all the collected
+// metrics, so that they are out of order with respect to the previous scrape.
+// Otherwise, it attaches the current time offset by skew if skew is non-zero,
+// and no timestamp at all if it is zero.
+type outOfOrderCollector struct {
+	prometheus.Collector
+	rate    float64
+	age     time.Duration
+	skew    time.Duration
+	samples prometheus.Counter // Counts the out-of-order samples.
+
+	mtx sync.Mutex
+	rng *rand.Rand
+}
+
+func (c *outOfOrderCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	ooo := c.rng.Float64() < c.rate
+	c.mtx.Unlock()
+	if !ooo {
+		if c.skew == 0 {
+			c.Collector.Collect(ch)
+			return
+		}
+		skewedCollector{c.Collector, c.skew}.Collect(ch)
+		return
+	}
+	ts := time.Now().Add(c.skew - c.age)
+	in := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(in)
+		close(in)
+	}()
+	for m := range in {
+		c.samples.Inc()
+		ch <- prometheus.NewMetricWithTimestamp(ts, m)
+	}
+}
+
+// resettableCounter is a prometheus.Counter whose value can be decreased
+// without creating a new counter, simulating a buggy exporter.
+type resettableCounter struct {
+	desc *prometheus.Desc
+
+	mtx   sync.Mutex
+	value float64
+}
+
+func newResettableCounter(opts prometheus.CounterOpts) *resettableCounter {
+	return &resettableCounter{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help, nil, opts.ConstLabels,
+		),
+	}
+}
+
+func (c *resettableCounter) Inc() { c.Add(1) }
+
+func (c *resettableCounter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease in value")
+	}
+	c.mtx.Lock()
+	c.value += v
+	c.mtx.Unlock()
+}
+
+// reset multiplies the value of the counter by f, which is between 0 and 1,
+// and rounds down.
+func (c *resettableCounter) reset(f float64) {
+	c.mtx.Lock()
+	c.value = math.Floor(c.value * f)
+	c.mtx.Unlock()
+}
+
+func (c *resettableCounter) metric() prometheus.Metric {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, c.value)
+}
+
+func (c *resettableCounter) Desc() *prometheus.Desc              { return c.desc }
+func (c *resettableCounter) Write(m *dto.Metric) error           { return c.metric().Write(m) }
+func (c *resettableCounter) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+func (c *resettableCounter) Collect(ch chan<- prometheus.Metric) { ch <- c.metric() }
+
+// staleNaN is the bit pattern Prometheus uses to mark a series as stale.
+const staleNaN = 0x7ff0000000000002
+
+// staleMarkers keeps the counters and gauges of stopped tasks, with a stale
+// marker as their value, for each of its consumers (see collector) to expose
+// once more, to the next gather of that consumer only.
+type staleMarkers struct {
+	mtx     sync.Mutex
+	pending []map[taskKey][]prometheus.Metric // By consumer.
+}
+
+func newStaleMarkers() *staleMarkers {
+	return &staleMarkers{}
+}
+
+// collector returns a new consumer of the stale markers, which collects the
+// markers added since its previous collection. It is an unchecked collector,
+// as its series come and go with the tasks.
+func (sm *staleMarkers) collector() prometheus.Collector {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	i := len(sm.pending)
+	sm.pending = append(sm.pending, map[taskKey][]prometheus.Metric{})
+	return staleCollector(func(ch chan<- prometheus.Metric) {
+		sm.mtx.Lock()
+		metrics := sm.pending[i]
+		sm.pending[i] = map[taskKey][]prometheus.Metric{}
+		sm.mtx.Unlock()
+		ts := time.Now()
+		for _, ms := range metrics {
+			for _, m := range ms {
+				ch <- prometheus.NewMetricWithTimestamp(ts, m)
+			}
+		}
+	})
+}
+
+// gatherer returns a Gatherer for the metrics gathered by g along with the
+// stale markers of a new consumer.
+func (sm *staleMarkers) gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(sm.collector())
+	return prometheus.Gatherers{g, reg}
+}
+
+// staleCollector is an unchecked prometheus.Collector collecting by calling
+// itself.
+type staleCollector func(ch chan<- prometheus.Metric)
+
+func (c staleCollector) Describe(chan<- *prometheus.Desc)    {}
+func (c staleCollector) Collect(ch chan<- prometheus.Metric) { c(ch) }
+
+// add adds stale markers for the counters and gauges currently collected by cs,
+// which belong to the task k.
+func (sm *staleMarkers) add(k taskKey, cs []prometheus.Collector) {
+	in := make(chan prometheus.Metric)
+	go func() {
+		for _, c := range cs {
+			c.Collect(in)
+		}
+		close(in)
+	}()
+	var ms []prometheus.Metric
+	for m := range in {
+		var d dto.Metric
+		if err := m.Write(&d); err != nil {
+			continue
+		}
+		v := math.Float64frombits(staleNaN)
+		switch {
+		case d.Counter != nil:
+			d = dto.Metric{Label: d.Label, Counter: &dto.Counter{Value: &v}}
+		case d.Gauge != nil:
+			d = dto.Metric{Label: d.Label, Gauge: &dto.Gauge{Value: &v}}
+		case d.Untyped != nil:
+			d = dto.Metric{Label: d.Label, Untyped: &dto.Untyped{Value: &v}}
+		default:
+			// Histograms and summaries have integer counts, which
+			// cannot be marked as stale.
+			continue
+		}
+		ms = append(ms, staleMetric{m.Desc(), &d})
+	}
+	sm.mtx.Lock()
+	for _, metrics := range sm.pending {
+		metrics[k] = ms
+	}
+	sm.mtx.Unlock()
+}
+
+// drop drops the stale markers of the task k, so that a new task with the same
+// key can expose the same series.
+func (sm *staleMarkers) drop(k taskKey) {
+	sm.mtx.Lock()
+	for _, metrics := range sm.pending {
+		delete(metrics, k)
+	}
+	sm.mtx.Unlock()
+}
+
+// staleMetric is a prometheus.Metric with a fixed dto.Metric.
+type staleMetric struct {
+	desc *prometheus.Desc
+	m    *dto.Metric
+}
+
+func (m staleMetric) Desc() *prometheus.Desc { return m.desc }
+
+func (m staleMetric) Write(out *dto.Metric) error {
+	out.Label = m.m.Label
+	out.Counter = m.m.Counter
+	out.Gauge = m.m.Gauge
+	out.Untyped = m.m.Untyped
+	return nil
+}
+
+// paddingLength is the length of the padding label value of the padding series.
+const paddingLength = 100
+
+// paddingCollector exposes n gauges with long label values to inflate the
+// exposition, see PaddingSeries.
+type paddingCollector struct {
+	desc *prometheus.Desc
+	n    int
+	pad  string
+}
+
+func newPaddingCollector(n int) *paddingCollector {
+	return &paddingCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "padding"),
+			"Dummy series inflating the size of the exposition, always 0.",
+			[]string{"series", "padding"}, nil,
+		),
+		n:   n,
+		pad: strings.Repeat("x", paddingLength),
+	}
+}
+
+func (c *paddingCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *paddingCollector) Collect(ch chan<- prometheus.Metric) {
+	for i := 0; i < c.n; i++ {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 0, strconv.Itoa(i), c.pad)
+	}
+}
+
+// paddingSeriesFor returns the number of padding series that add about size
+// bytes to the text exposition.
+func paddingSeriesFor(size int) int {
+	pad, n := strings.Repeat("x", paddingLength), 0
+	for added := 0; added < size; n++ {
+		added += len(fmt.Sprintf("%s_padding{padding=%q,series=\"%d\"} 0\n", namespace, pad, n))
+	}
+	return n
+}
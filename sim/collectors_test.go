@@ -0,0 +1,45 @@
+package sim
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStaleMarkersPerConsumer(t *testing.T) {
+	cfg := testConfig()
+	cfg.ExplicitStaleness = true
+	s := run(t, cfg)
+	// Another consumer, like remote write.
+	other := s.withStaleMarkers(s.gatherer)
+	waitFor(t, "queries", func() bool {
+		return strings.Contains(scrapeText(t, s.Handler(), ""), `queries_total{batch="0",task="1"}`)
+	})
+
+	s.scale(t.Context(), -1)
+	waitFor(t, "stale markers of the other consumer", func() bool {
+		mfs, err := other.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "queries_total" {
+				continue
+			}
+			for _, m := range mf.Metric {
+				if math.IsNaN(m.GetCounter().GetValue()) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	// The other consumer must not have taken the markers from the scrape.
+	const stale = `queries_total{batch="0",task="1"} NaN`
+	if body := scrapeText(t, s.Handler(), ""); !strings.Contains(body, stale) {
+		t.Errorf("first scrape after the stop lacks %s:\n%s", stale, body)
+	}
+	if body := scrapeText(t, s.Handler(), ""); strings.Contains(body, `task="1"`) {
+		t.Errorf("second scrape after the stop still exposes the stopped task:\n%s", body)
+	}
+}
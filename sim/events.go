@@ -0,0 +1,108 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of Events.
+const (
+	EventTaskStart     = "task_start"
+	EventTaskStop      = "task_stop"
+	EventTaskCrash     = "task_crash"
+	EventTaskStuck     = "task_stuck"
+	EventLoss          = "loss"
+	EventBatchStart    = "batch_start"
+	EventBatchComplete = "batch_complete"
+	EventScale         = "scale"
+)
+
+// Event is a lifecycle event of a simulation, see Subscribe.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Batch is the batch of the task, or the current batch for events not
+	// about a single task.
+	Batch int `json:"batch"`
+	// Task is the id of the task, nil for events not about a single task
+	// (like an EventLoss with CorrelatedLoss).
+	Task *int `json:"task,omitempty"`
+	// Tasks is the number of tasks after an EventScale.
+	Tasks int `json:"tasks,omitempty"`
+}
+
+// eventBufferSize is the number of events buffered per subscriber. Further
+// events are dropped until the subscriber catches up.
+const eventBufferSize = 1024
+
+// broadcaster sends the published events to all subscribers.
+type broadcaster struct {
+	mtx    sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: map[chan Event]struct{}{}}
+}
+
+// publish sends e to all subscribers without blocking.
+func (b *broadcaster) publish(e Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (b *broadcaster) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close closes the channels of all current and future subscribers.
+func (b *broadcaster) close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+// Subscribe returns a channel receiving the lifecycle events of the simulation
+// from now on, and a function to cancel the subscription. Events are dropped
+// while the channel is full. The channel is closed once Run returns or the
+// subscription is canceled.
+func (s *Simulator) Subscribe() (events <-chan Event, cancel func()) {
+	return s.events.subscribe()
+}
+
+// publish publishes e with the current time.
+func (s *Simulator) publish(e Event) {
+	e.Time = time.Now()
+	s.events.publish(e)
+}
+
+// publishTask publishes an event of the given type about a single task.
+func (s *Simulator) publishTask(typ string, id, batch int) {
+	s.publish(Event{Type: typ, Batch: batch, Task: &id})
+}
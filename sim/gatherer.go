@@ -0,0 +1,75 @@
+package sim
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// lossyGatherer wraps a Gatherer and drops a random fraction of the gathered
+// metric families on each call of Gather, as a scrape cut short somewhere in
+// the middle would. The self-metrics of rrsim are never dropped.
+type lossyGatherer struct {
+	prometheus.Gatherer
+	fraction float64
+
+	mtx sync.Mutex
+	rng *rand.Rand
+}
+
+func (g *lossyGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	kept := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), namespace+"_") || g.rng.Float64() >= g.fraction {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
+
+// loseScrapes decides every LossCheckInterval with probability Loss whether
+// all scrapes fail during the next LossDuration, until ctx is done.
+func (s *Simulator) loseScrapes(ctx context.Context) {
+	losses := s.newDecider(rand.New(rand.NewSource(s.cfg.Seed)))
+	ticker := time.NewTicker(s.cfg.LossCheckInterval)
+	defer ticker.Stop()
+	var (
+		restore  *time.Timer
+		restoreC <-chan time.Time // Non-nil while scrapes fail.
+	)
+	defer func() {
+		if restore != nil {
+			restore.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			s.scrapeLost.Store(false)
+			return
+		case <-restoreC:
+			restoreC = nil
+			s.scrapeLost.Store(false)
+		case <-ticker.C:
+			if restoreC == nil && losses.decide(s.Params().Loss) {
+				s.log.Debug("Failing scrapes", "duration", s.cfg.LossDuration)
+				s.metrics.lossEvents.Inc()
+				s.scrapeLost.Store(true)
+				s.mtx.Lock()
+				batch := s.batch
+				s.mtx.Unlock()
+				s.publish(Event{Type: EventLoss, Batch: batch})
+				restore = time.NewTimer(s.cfg.LossDuration)
+				restoreC = restore.C
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package sim
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLossyGathererDropsFamilies(t *testing.T) {
+	var mfs []*dto.MetricFamily
+	for _, name := range []string{"a", "b", "c", "d", namespace + "_tasks"} {
+		mf := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum()}
+		for i := 0; i < 3; i++ {
+			mf.Metric = append(mf.Metric, &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(float64(i))}})
+		}
+		mfs = append(mfs, mf)
+	}
+	g := &lossyGatherer{
+		Gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil }),
+		fraction: 0.5,
+		rng:      rand.New(rand.NewSource(1)),
+	}
+
+	var dropped int
+	for i := 0; i < 100; i++ {
+		got, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		self := false
+		for _, mf := range got {
+			if n := len(mf.Metric); n != 3 {
+				t.Fatalf("family %s has %d series, want all 3", mf.GetName(), n)
+			}
+			self = self || mf.GetName() == namespace+"_tasks"
+		}
+		if !self {
+			t.Fatal("self-metrics were dropped")
+		}
+		dropped += len(mfs) - len(got)
+	}
+	if dropped == 0 {
+		t.Error("no family was ever dropped")
+	}
+	if len(mfs) != 5 {
+		t.Errorf("the gathered families were modified, got %d of them", len(mfs))
+	}
+}
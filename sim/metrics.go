@@ -0,0 +1,156 @@
+package sim
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespace is the namespace of the metrics about the simulator itself, as
+// opposed to the metrics of the simulated tasks.
+const namespace = "rrsim"
+
+type selfMetrics struct {
+	activeTasks atomic.Int64
+	batchTasks  *batchTasks
+	restarts    prometheus.Counter
+	lossEvents  prometheus.Counter
+	outOfOrder  prometheus.Counter
+	// registrationConflicts counts the collectors of tasks that could not
+	// be registered.
+	registrationConflicts prometheus.Counter
+	// queryInterval observes the measured time between consecutive
+	// queries of the same task.
+	queryInterval prometheus.Histogram
+
+	restartInProgress prometheus.Gauge
+	restartProgress   prometheus.Gauge
+	currentBatch      prometheus.Gauge
+	scrapeDuration    prometheus.Histogram
+
+	remoteWriteFailures prometheus.Counter
+}
+
+func newSelfMetrics(reg prometheus.Registerer, version, revision string) *selfMetrics {
+	m := &selfMetrics{
+		batchTasks: &batchTasks{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "", "batch_tasks"),
+				"Number of currently running simulated tasks by restart batch.",
+				[]string{"batch"}, nil,
+			),
+			running: map[int]int{},
+		},
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "restarts_total",
+			Help:      "Number of restart batches initiated.",
+		}),
+		lossEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "loss_events_total",
+			Help:      "Number of times the metrics of a task (or the whole exposition with correlated loss) have been removed to simulate a lost scrape.",
+		}),
+		outOfOrder: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "out_of_order_samples_total",
+			Help:      "Number of samples exposed with a timestamp in the past to simulate out-of-order samples.",
+		}),
+		registrationConflicts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "registration_conflicts_total",
+			Help:      "Number of metrics of simulated tasks not exposed because they collided with metrics registered already.",
+		}),
+		queryInterval: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "query_interval_seconds",
+			Help:      "Measured wall-clock time between consecutive queries served by the same simulated task, across all tasks. Bursts are not included.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}),
+		restartInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "restart_in_progress",
+			Help:      "1 while a restart batch is in progress, 0 otherwise.",
+		}),
+		restartProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "restart_progress",
+			Help:      "Fraction of the tasks replaced so far by the restart batch in progress, 0 if none is in progress.",
+		}),
+		scrapeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "scrape_duration_seconds",
+			Help:      "Time spent serving scrapes of the metrics endpoint, including gathering, serializing, and compressing the metrics.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		currentBatch: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "current_batch",
+			Help:      "Number of the most recently initiated restart batch, 0 for the initial one.",
+		}),
+		remoteWriteFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "remote_write_failures_total",
+			Help:      "Number of remote writes given up on, either after retrying or because the receiver refused them.",
+		}),
+	}
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_tasks",
+			Help:      "Number of currently running simulated tasks.",
+		}, func() float64 { return float64(m.activeTasks.Load()) }),
+		m.batchTasks,
+		m.restarts,
+		m.lossEvents,
+		m.outOfOrder,
+		m.registrationConflicts,
+		m.queryInterval,
+		m.restartInProgress,
+		m.restartProgress,
+		m.currentBatch,
+		m.scrapeDuration,
+		m.remoteWriteFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_info",
+			Help:      "A metric with a constant '1' value labeled by the version and revision of rrsim and the Go version it was built with.",
+			ConstLabels: prometheus.Labels{
+				"version":    version,
+				"revision":   revision,
+				"go_version": runtime.Version(),
+			},
+		}, func() float64 { return 1 }),
+	)
+	return m
+}
+
+// batchTasks counts the running tasks by batch. Batches without running tasks
+// are not exposed.
+type batchTasks struct {
+	desc *prometheus.Desc
+
+	mtx     sync.Mutex
+	running map[int]int
+}
+
+func (b *batchTasks) add(batch, delta int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.running[batch] += delta; b.running[batch] == 0 {
+		delete(b.running, batch)
+	}
+}
+
+func (b *batchTasks) Describe(ch chan<- *prometheus.Desc) { ch <- b.desc }
+
+func (b *batchTasks) Collect(ch chan<- prometheus.Metric) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for batch, n := range b.running {
+		ch <- prometheus.MustNewConstMetric(b.desc, prometheus.GaugeValue, float64(n), strconv.Itoa(batch))
+	}
+}
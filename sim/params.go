@@ -0,0 +1,55 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Params are the parameters of a Simulator that can be changed while it is
+// running. Their initial values are taken from the Config.
+type Params struct {
+	QPS    float64 `json:"qps"`
+	Jitter float64 `json:"jitter"`
+	Loss   float64 `json:"loss"`
+	// ErrorRate can only be changed at runtime if it was non-zero in the
+	// Config, as otherwise queries_total has no status label.
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// Validate returns an error listing all invalid values in p, or nil if there
+// are none.
+func (p Params) Validate() error {
+	var errs []error
+	if !(p.QPS > 0) {
+		errs = append(errs, fmt.Errorf("qps must be positive, got %v", p.QPS))
+	}
+	if !(p.Jitter >= 0) {
+		errs = append(errs, fmt.Errorf("jitter must not be negative, got %v", p.Jitter))
+	}
+	if !(p.Loss >= 0 && p.Loss <= 1) {
+		errs = append(errs, fmt.Errorf("loss must be between 0 and 1, got %v", p.Loss))
+	}
+	if !(p.ErrorRate >= 0 && p.ErrorRate <= 1) {
+		errs = append(errs, fmt.Errorf("error rate must be between 0 and 1, got %v", p.ErrorRate))
+	}
+	return errors.Join(errs...)
+}
+
+// Params returns the current parameters of the simulation.
+func (s *Simulator) Params() Params {
+	return *s.params.Load()
+}
+
+// SetParams changes the parameters of the simulation. Running tasks pick up
+// the change with their next query or loss decision.
+func (s *Simulator) SetParams(p Params) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if s.cfg.ErrorRate == 0 && p.ErrorRate != 0 {
+		return errors.New("error rate cannot be changed at runtime if it was zero at the start")
+	}
+	s.params.Store(&p)
+	s.log.Info("Parameters changed", "qps", p.QPS, "jitter", p.Jitter, "loss", p.Loss, "error_rate", p.ErrorRate)
+	return nil
+}
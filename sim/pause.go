@@ -0,0 +1,103 @@
+package sim
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pauseState is whether a Simulator is paused, with a channel to wait for
+// changes.
+type pauseState struct {
+	mtx     sync.Mutex
+	paused  bool
+	changed chan struct{} // Closed and replaced whenever paused changes.
+}
+
+func newPauseState(paused bool) *pauseState {
+	return &pauseState{paused: paused, changed: make(chan struct{})}
+}
+
+func (p *pauseState) get() (paused bool, changed <-chan struct{}) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.paused, p.changed
+}
+
+// set returns false if paused has not changed.
+func (p *pauseState) set(paused bool) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return true
+}
+
+// Pause freezes the simulation: Tasks stop serving queries, keeping their
+// metrics exposed with their current values, and the schedule of restart
+// batches is suspended until Resume is called.
+func (s *Simulator) Pause() {
+	if s.pause.set(true) {
+		s.log.Info("Simulation paused")
+	}
+}
+
+// Resume continues a simulation paused by Pause.
+func (s *Simulator) Resume() {
+	if s.pause.set(false) {
+		s.log.Info("Simulation resumed")
+	}
+}
+
+// Paused returns whether the simulation is paused.
+func (s *Simulator) Paused() bool {
+	paused, _ := s.pause.get()
+	return paused
+}
+
+// sleep waits for d, not counting the time the simulation is paused, and
+// returns false if ctx is done first.
+func (s *Simulator) sleep(ctx context.Context, d time.Duration) bool {
+	_, ok := s.sleepOrRestart(ctx, d, nil)
+	return ok
+}
+
+// sleepOrRestart is like sleep but returns early if a restart request is
+// received from requests, returning the channel to reply to.
+func (s *Simulator) sleepOrRestart(ctx context.Context, d time.Duration, requests <-chan chan<- int) (chan<- int, bool) {
+	for {
+		paused, changed := s.pause.get()
+		var (
+			t      *time.Timer
+			timerC <-chan time.Time // Nil while paused.
+		)
+		if !paused {
+			t = time.NewTimer(d)
+			timerC = t.C
+		}
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+		case <-timerC:
+			return nil, true
+		case reply := <-requests:
+			if t != nil {
+				t.Stop()
+			}
+			return reply, true
+		case <-changed:
+		}
+		if t != nil {
+			t.Stop()
+			// Keep the remaining time for after the pause.
+			d -= time.Since(start)
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+	}
+}
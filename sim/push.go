@@ -0,0 +1,90 @@
+package sim
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	maxPushAttempts  = 5
+	initialPushRetry = 100 * time.Millisecond
+)
+
+// pushTask pushes the metrics collected by cs of the given task to the
+// Pushgateway every PushInterval until done is closed. Then it pushes one last
+// time and deletes the pushed metrics if PushDeleteOnStop is set.
+func (s *Simulator) pushTask(log *slog.Logger, id, batch int, cs []prometheus.Collector, done <-chan struct{}) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cs...)
+	// The Pushgateway adds the grouping labels itself and refuses pushed
+	// metrics that already have them.
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := reg.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.Label = withoutLabels(m.Label, s.cfg.BatchLabel, s.cfg.TaskLabel)
+			}
+		}
+		return mfs, err
+	})
+	p := push.New(s.cfg.Pushgateway, s.cfg.Job).
+		Gatherer(g).
+		Grouping(s.cfg.BatchLabel, fmt.Sprint(batch)).
+		Grouping(s.cfg.TaskLabel, fmt.Sprint(id))
+
+	ticker := time.NewTicker(s.cfg.PushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			retry(log, "push", p.Push)
+		case <-done:
+			retry(log, "push", p.Push)
+			if s.cfg.PushDeleteOnStop {
+				retry(log, "delete", p.Delete)
+			}
+			return
+		}
+	}
+}
+
+// retry calls f until it succeeds, with exponential backoff between attempts,
+// giving up after maxPushAttempts.
+func retry(log *slog.Logger, op string, f func() error) {
+	backoff := initialPushRetry
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return
+		}
+		if attempt == maxPushAttempts {
+			log.Error("Giving up on Pushgateway operation", "op", op, "err", err)
+			return
+		}
+		log.Warn("Pushgateway operation failed, retrying", "op", op, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// withoutLabels returns the label pairs of lps not named by any of names. The
+// result is a new slice, as the gathered lps share their backing array with the
+// metric they were collected from.
+func withoutLabels(lps []*dto.LabelPair, names ...string) []*dto.LabelPair {
+	kept := make([]*dto.LabelPair, 0, len(lps))
+outer:
+	for _, lp := range lps {
+		for _, n := range names {
+			if lp.GetName() == n {
+				continue outer
+			}
+		}
+		kept = append(kept, lp)
+	}
+	return kept
+}
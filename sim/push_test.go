@@ -0,0 +1,50 @@
+package sim
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushKeepsExposition(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		pushes []string // Paths of the successful pushes.
+	)
+	pgw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		pushes = append(pushes, r.Method+" "+r.URL.Path)
+	}))
+	defer pgw.Close()
+
+	cfg := testConfig()
+	cfg.Num = 1
+	cfg.Pushgateway = pgw.URL
+	cfg.PushInterval = 20 * time.Millisecond
+	// The status label sorts between the batch and the task label.
+	cfg.ErrorRate = 0.1
+	s := run(t, cfg)
+	waitFor(t, "three pushes", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(pushes) >= 3
+	})
+
+	mtx.Lock()
+	for _, p := range pushes {
+		// The order of the grouping labels is not defined.
+		if !strings.HasPrefix(p, "PUT /metrics/job/rrsim/") || !strings.Contains(p, "/batch/0") || !strings.Contains(p, "/task/0") {
+			t.Errorf("got push %q, want PUT to the group of batch 0 and task 0", p)
+		}
+	}
+	mtx.Unlock()
+	// Pushing must leave the labels of the exposed metrics alone.
+	body := scrapeText(t, s.Handler(), "")
+	if want := `queries_total{batch="0",status="success",task="0"}`; !strings.Contains(body, want) {
+		t.Errorf("exposition lacks %s:\n%s", want, body)
+	}
+}
@@ -0,0 +1,175 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const defaultRemoteWriteInterval = 15 * time.Second
+
+// remoteWrite sends the gathered metrics to RemoteWriteURL every
+// RemoteWriteInterval until ctx is done. Writes failing with a 5xx status or
+// without any response within RemoteWriteInterval are retried with exponential
+// backoff, giving up after maxPushAttempts.
+func (s *Simulator) remoteWrite(ctx context.Context) {
+	log := s.log.With("url", s.cfg.RemoteWriteURL)
+	// A receiver not answering must not hold up the writes.
+	client := &http.Client{Timeout: s.cfg.RemoteWriteInterval}
+	g := s.withStaleMarkers(s.gatherer)
+	ticker := time.NewTicker(s.cfg.RemoteWriteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Warn("Error gathering metrics for remote write", "err", err)
+		}
+		body := snappy.Encode(nil, writeRequest(mfs, s.cfg.Job, time.Now().UnixMilli()))
+		backoff := initialPushRetry
+		for attempt := 1; ; attempt++ {
+			retryable, err := s.sendWrite(ctx, client, body)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if !retryable || attempt == maxPushAttempts {
+				log.Error("Giving up on remote write", "attempts", attempt, "err", err)
+				s.metrics.remoteWriteFailures.Inc()
+				break
+			}
+			log.Warn("Remote write failed, retrying", "backoff", backoff, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// sendWrite posts the snappy-compressed write request in body via client and
+// returns whether a failure is worth retrying.
+func (s *Simulator) sendWrite(ctx context.Context, client *http.Client, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "rrsim/"+s.cfg.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return resp.StatusCode/100 == 5, fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// writeRequest returns the protobuf encoding of a remote-write (v1)
+// WriteRequest with the series of mfs as they would appear after a scrape with
+// the given job label and the given timestamp for samples without one. The
+// messages are encoded by hand to not depend on the Prometheus server module
+// just for prompb. Native histograms are sent as classic ones, i.e. only with
+// their count and sum if they have no classic buckets.
+func writeRequest(mfs []*dto.MetricFamily, job string, now int64) []byte {
+	var b []byte
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(suffix string, v float64, extra ...string) {
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				b = protowire.AppendBytes(b, timeSeries(name+suffix, job, m.Label, extra, v, ts))
+			}
+			switch {
+			case m.Counter != nil:
+				add("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				add("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				h := m.Histogram
+				if len(h.Bucket) > 0 {
+					for _, bkt := range h.Bucket {
+						if !math.IsInf(bkt.GetUpperBound(), +1) {
+							add("_bucket", float64(bkt.GetCumulativeCount()), "le", formatFloat(bkt.GetUpperBound()))
+						}
+					}
+					add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+// timeSeries returns the protobuf encoding of a TimeSeries with a single
+// sample. The labels are sorted by name, as remote write requires.
+func timeSeries(name, job string, lps []*dto.LabelPair, extra []string, v float64, ts int64) []byte {
+	labels := make([][2]string, 0, len(lps)+len(extra)/2+2)
+	labels = append(labels, [2]string{"__name__", name}, [2]string{"job", job})
+	for _, lp := range lps {
+		labels = append(labels, [2]string{lp.GetName(), lp.GetValue()})
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels = append(labels, [2]string{extra[i], extra[i+1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+	var b, l []byte
+	for _, lv := range labels {
+		l = protowire.AppendTag(l[:0], 1, protowire.BytesType)
+		l = protowire.AppendString(l, lv[0])
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, lv[1])
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+	l = protowire.AppendTag(l[:0], 1, protowire.Fixed64Type)
+	l = protowire.AppendFixed64(l, math.Float64bits(v))
+	l = protowire.AppendTag(l, 2, protowire.VarintType)
+	l = protowire.AppendVarint(l, uint64(ts))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, l)
+}
+
+// formatFloat formats f like the text format does for le and quantile labels.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
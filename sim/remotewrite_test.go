@@ -0,0 +1,228 @@
+package sim
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// sample is a decoded TimeSeries of a remote-write request, with its labels
+// in the order of the encoding.
+type sample struct {
+	labels []string // Names and values, alternating.
+	v      float64
+	ts     int64
+}
+
+// decodeWriteRequest decodes the fields of the WriteRequest in b that
+// writeRequest encodes.
+func decodeWriteRequest(t *testing.T, b []byte) []sample {
+	t.Helper()
+	// fields calls f for each field of the message in b.
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			if m < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(m))
+			}
+			f(num, typ, b[:m])
+			b = b[m:]
+		}
+	}
+	bytesValue := func(v []byte) []byte {
+		b, n := protowire.ConsumeBytes(v)
+		if n < 0 {
+			t.Fatalf("invalid bytes: %v", protowire.ParseError(n))
+		}
+		return b
+	}
+	var samples []sample
+	fields(b, func(num protowire.Number, _ protowire.Type, v []byte) {
+		if num != 1 {
+			t.Fatalf("unexpected WriteRequest field %d", num)
+		}
+		var s sample
+		fields(bytesValue(v), func(num protowire.Number, _ protowire.Type, v []byte) {
+			switch num {
+			case 1:
+				fields(bytesValue(v), func(_ protowire.Number, _ protowire.Type, v []byte) {
+					s.labels = append(s.labels, string(bytesValue(v)))
+				})
+			case 2:
+				fields(bytesValue(v), func(num protowire.Number, _ protowire.Type, v []byte) {
+					switch num {
+					case 1:
+						x, _ := protowire.ConsumeFixed64(v)
+						s.v = math.Float64frombits(x)
+					case 2:
+						x, _ := protowire.ConsumeVarint(v)
+						s.ts = int64(x)
+					}
+				})
+			}
+		})
+		samples = append(samples, s)
+	})
+	return samples
+}
+
+func TestWriteRequest(t *testing.T) {
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	}
+	mfs := []*dto.MetricFamily{
+		{
+			Name: proto.String("queries_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{label("task", "0"), label("batch", "1")},
+				Counter: &dto.Counter{Value: proto.Float64(42)},
+			}},
+		},
+		{
+			Name: proto.String("query_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(0.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+						{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(3)},
+					},
+				},
+				TimestampMs: proto.Int64(1000),
+			}},
+		},
+	}
+	want := []sample{
+		{[]string{"__name__", "queries_total", "batch", "1", "job", "rrsim", "task", "0"}, 42, 2000},
+		{[]string{"__name__", "query_duration_seconds_bucket", "job", "rrsim", "le", "0.1"}, 2, 1000},
+		{[]string{"__name__", "query_duration_seconds_bucket", "job", "rrsim", "le", "+Inf"}, 3, 1000},
+		{[]string{"__name__", "query_duration_seconds_sum", "job", "rrsim"}, 0.5, 1000},
+		{[]string{"__name__", "query_duration_seconds_count", "job", "rrsim"}, 3, 1000},
+	}
+	got := decodeWriteRequest(t, writeRequest(mfs, "rrsim", 2000))
+	if !slices.EqualFunc(got, want, func(a, b sample) bool {
+		return slices.Equal(a.labels, b.labels) && a.v == b.v && a.ts == b.ts
+	}) {
+		t.Errorf("got samples\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		headers []http.Header
+		bodies  [][]byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		headers = append(headers, r.Header.Clone())
+		bodies = append(bodies, b)
+	}))
+	defer srv.Close()
+
+	cfg := testConfig()
+	cfg.RemoteWriteURL = srv.URL
+	cfg.RemoteWriteInterval = 20 * time.Millisecond
+	run(t, cfg)
+	waitFor(t, "a remote write", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(headers) > 0
+	})
+
+	mtx.Lock()
+	header, body := headers[0], bodies[0]
+	mtx.Unlock()
+	for name, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("decoding snappy: %v", err)
+	}
+	var queries int
+	for _, s := range decodeWriteRequest(t, b) {
+		if !slices.IsSortedFunc(pairs(s.labels), func(a, b [2]string) int { return strings.Compare(a[0], b[0]) }) {
+			t.Errorf("labels %q not sorted by name", s.labels)
+		}
+		if s.labels[1] == "queries_total" {
+			queries++
+		}
+	}
+	if queries != cfg.Num {
+		t.Errorf("got %d series of queries_total, want %d", queries, cfg.Num)
+	}
+}
+
+// pairs returns the alternating names and values of labels as pairs.
+func pairs(labels []string) [][2]string {
+	var ps [][2]string
+	for i := 0; i+1 < len(labels); i += 2 {
+		ps = append(ps, [2]string{labels[i], labels[i+1]})
+	}
+	return ps
+}
+
+func TestRemoteWriteTimeout(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		attempts int
+	)
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		attempts++
+		mtx.Unlock()
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	cfg := testConfig()
+	cfg.RemoteWriteURL = srv.URL
+	cfg.RemoteWriteInterval = 20 * time.Millisecond
+	s := run(t, cfg)
+	// A hanging receiver counts as a failed attempt, so that the write is
+	// eventually given up on.
+	waitFor(t, "the write to be given up on", func() bool {
+		return strings.Contains(scrapeText(t, s.Handler(), ""), "rrsim_remote_write_failures_total 1")
+	})
+	mtx.Lock()
+	defer mtx.Unlock()
+	if attempts < maxPushAttempts {
+		t.Errorf("got %d attempts, want at least %d", attempts, maxPushAttempts)
+	}
+}
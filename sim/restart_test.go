@@ -0,0 +1,65 @@
+package sim
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// counterValues returns the values of queries_total in the text exposition
+// served by s, by batch and task label.
+func counterValues(t *testing.T, s *Simulator) map[[2]string]float64 {
+	t.Helper()
+	re := regexp.MustCompile(`(?m)^queries_total\{batch="(\d+)",task="(\d+)"\} (\S+)$`)
+	values := map[[2]string]float64{}
+	for _, m := range re.FindAllStringSubmatch(scrapeText(t, s.Handler(), ""), -1) {
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[[2]string{m[1], m[2]}] = v
+	}
+	return values
+}
+
+func TestRestartPreservesCounters(t *testing.T) {
+	cfg := testConfig()
+	cfg.PreserveOnRestart = true
+	cfg.Drain = 200 * time.Millisecond
+	s := run(t, cfg)
+	var before map[[2]string]float64
+	waitFor(t, "queries", func() bool {
+		before = counterValues(t, s)
+		return before[[2]string{"0", "0"}] > 0 && before[[2]string{"0", "1"}] > 0
+	})
+
+	batch, err := s.Restart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch != 1 {
+		t.Fatalf("got batch %d, want 1", batch)
+	}
+	// Scaling needs the lock held while rolling, so it must not be
+	// blocked by the draining predecessors.
+	time.Sleep(cfg.Drain / 4)
+	start := time.Now()
+	s.scale(t.Context(), 1)
+	if d := time.Since(start); d > cfg.Drain/2 {
+		t.Errorf("scaling was blocked for %v by the restart", d)
+	}
+	waitFor(t, "restart batch to replace the initial tasks", func() bool {
+		after := counterValues(t, s)
+		_, ok0 := after[[2]string{"1", "0"}]
+		_, ok1 := after[[2]string{"1", "1"}]
+		return ok0 && ok1 && len(after) == 3
+	})
+	after := counterValues(t, s)
+	for _, id := range []string{"0", "1"} {
+		if b, a := before[[2]string{"0", id}], after[[2]string{"1", id}]; a < b {
+			t.Errorf("counter of task %s dropped from %v to %v across the restart", id, b, a)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package sim
+
+import (
+	"sort"
+	"time"
+)
+
+// ScheduleEvent is a planned event of a simulation, see Schedule.
+type ScheduleEvent struct {
+	// At is the time after the start of the simulation.
+	At    time.Duration
+	Batch int
+	// Task is the id of the task started or stopped, or -1 for the start
+	// of a restart batch.
+	Task int
+	// Start is set for the start of a task or restart batch, and unset for
+	// the stop of a task, i.e. once its metrics are gone.
+	Start bool
+}
+
+// Schedule returns the planned events of the simulation up to and including
+// the given number of restart batches (at most MaxRestarts), sorted by time.
+// If the last of them is the last one overall, the final stop of its tasks is
+// included. The schedule assumes that all restarts happen on time, that the
+// simulation is neither paused nor scaled, and that no task crashes. Tasks
+// stopping with Drain and PreserveOnRestart are assumed not to hold up the
+// restart.
+func (s *Simulator) Schedule(batches int) []ScheduleEvent {
+	if s.cfg.MaxRestarts > 0 && batches > s.cfg.MaxRestarts {
+		batches = s.cfg.MaxRestarts
+	}
+	num := s.cfg.Num
+	var events []ScheduleEvent
+	if s.cfg.Prestart != PrestartNone {
+		for id := 0; id < num; id++ {
+			events = append(events, ScheduleEvent{Batch: 0, Task: id, Start: true})
+		}
+	}
+	// replace adds the events of the task with the given id in batch b-1
+	// being replaced by its successor in batch b at the given time, or
+	// only being stopped if final is set. Immortal tasks are only stopped
+	// in the initial batch if final is set.
+	replace := func(at time.Duration, b, id int, final bool) {
+		if s.immortal(id) {
+			if final {
+				events = append(events, ScheduleEvent{At: at + s.cfg.Drain, Batch: 0, Task: id})
+			}
+			return
+		}
+		stop := at + s.cfg.Drain
+		switch {
+		case final:
+		case s.cfg.Strategy == StrategyBlueGreen:
+			stop += s.cfg.BGOverlap
+		default:
+			stop += s.cfg.RestartOverlap
+		}
+		if !final {
+			events = append(events, ScheduleEvent{At: at, Batch: b, Task: id, Start: true})
+		}
+		if b > 1 || s.cfg.Prestart != PrestartNone {
+			events = append(events, ScheduleEvent{At: stop, Batch: b - 1, Task: id})
+		}
+	}
+	n := batches
+	if s.cfg.MaxRestarts > 0 && batches == s.cfg.MaxRestarts {
+		n++ // For the final stop, which happens like another restart.
+	}
+	start := s.cfg.RunDuration
+	for b := 1; b <= n; b++ {
+		final := b > batches
+		if !final {
+			events = append(events, ScheduleEvent{At: start, Batch: b, Task: -1, Start: true})
+		}
+		length := s.restartLength(num)
+		switch {
+		case s.cfg.Strategy == StrategyBlueGreen:
+			for id := 0; id < num; id++ {
+				replace(start, b, id, final)
+			}
+		case s.atOnce(b):
+			for _, id := range s.restartOrder(b, num) {
+				replace(start, b, id, final)
+			}
+			length = 0
+		default:
+			for i, id := range s.restartOrder(b, num) {
+				replace(start+s.restartOffset(i, num), b, id, final)
+			}
+		}
+		start += length + s.cfg.RunDuration
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	return events
+}
@@ -0,0 +1,120 @@
+package sim
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	const m = time.Minute
+	start := func(at time.Duration, batch, task int) ScheduleEvent {
+		return ScheduleEvent{At: at, Batch: batch, Task: task, Start: true}
+	}
+	stop := func(at time.Duration, batch, task int) ScheduleEvent {
+		return ScheduleEvent{At: at, Batch: batch, Task: task}
+	}
+	for _, tc := range []struct {
+		name    string
+		modify  func(*Config)
+		batches int
+		want    []ScheduleEvent
+	}{
+		{
+			"rolling",
+			func(*Config) {},
+			1,
+			[]ScheduleEvent{
+				start(0, 0, 0), start(0, 0, 1),
+				start(10*m, 1, -1),
+				start(10*m, 1, 0), stop(10*m, 0, 0),
+				start(11*m, 1, 1), stop(11*m, 0, 1),
+			},
+		},
+		{
+			"reverse order with overlap and drain",
+			func(c *Config) {
+				c.RestartOrder = RestartOrderReverse
+				c.RestartOverlap = 30 * time.Second
+				c.Drain = 10 * time.Second
+			},
+			1,
+			[]ScheduleEvent{
+				start(0, 0, 0), start(0, 0, 1),
+				start(10*m, 1, -1),
+				start(10*m, 1, 1), stop(10*m+40*time.Second, 0, 1),
+				start(11*m, 1, 0), stop(11*m+40*time.Second, 0, 0),
+			},
+		},
+		{
+			"blue-green",
+			func(c *Config) {
+				c.Strategy = StrategyBlueGreen
+				c.BGOverlap = 30 * time.Second
+			},
+			1,
+			[]ScheduleEvent{
+				start(0, 0, 0), start(0, 0, 1),
+				start(10*m, 1, -1),
+				start(10*m, 1, 0), start(10*m, 1, 1),
+				stop(10*m+30*time.Second, 0, 0), stop(10*m+30*time.Second, 0, 1),
+			},
+		},
+		{
+			"uniform prestart",
+			func(c *Config) { c.Prestart = PrestartUniform },
+			2,
+			[]ScheduleEvent{
+				start(0, 0, 0), start(0, 0, 1),
+				// All initial tasks live for the run duration.
+				start(10*m, 1, -1),
+				start(10*m, 1, 0), stop(10*m, 0, 0),
+				start(10*m, 1, 1), stop(10*m, 0, 1),
+				start(20*m, 2, -1),
+				start(20*m, 2, 0), stop(20*m, 1, 0),
+				start(21*m, 2, 1), stop(21*m, 1, 1),
+			},
+		},
+		{
+			"no prestart and the final stop",
+			func(c *Config) {
+				c.Prestart = PrestartNone
+				c.MaxRestarts = 1
+			},
+			5, // Capped at MaxRestarts.
+			[]ScheduleEvent{
+				start(10*m, 1, -1),
+				start(10*m, 1, 0),
+				start(11*m, 1, 1),
+				stop(22*m, 1, 0),
+				stop(23*m, 1, 1),
+			},
+		},
+		{
+			"the final stop",
+			func(c *Config) { c.MaxRestarts = 1 },
+			5, // Capped at MaxRestarts.
+			[]ScheduleEvent{
+				start(0, 0, 0), start(0, 0, 1),
+				start(10*m, 1, -1),
+				start(10*m, 1, 0), stop(10*m, 0, 0),
+				start(11*m, 1, 1), stop(11*m, 0, 1),
+				stop(22*m, 1, 0),
+				stop(23*m, 1, 1),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.RunDuration = 10 * m
+			cfg.RestartDuration = 2 * m
+			tc.modify(&cfg)
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("invalid config: %v", err)
+			}
+			if got := New(cfg).Schedule(tc.batches); !slices.Equal(got, tc.want) {
+				t.Errorf("got schedule\n%v\nwant\n%v", got, tc.want)
+			}
+		})
+	}
+}
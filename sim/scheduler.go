@@ -0,0 +1,159 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scheduler runs the timed events of all tasks on a fixed number of workers
+// rather than in a goroutine per task. Each task is bound to one worker, so
+// that the events of a task never run concurrently.
+type scheduler struct {
+	workers []*worker
+	next    atomic.Uint64
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newScheduler returns a scheduler with n running workers.
+func newScheduler(n int) *scheduler {
+	s := &scheduler{workers: make([]*worker, n), quit: make(chan struct{})}
+	for i := range s.workers {
+		w := &worker{wake: make(chan struct{}, 1)}
+		s.workers[i] = w
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			w.run(s.quit)
+		}()
+	}
+	return s
+}
+
+// worker returns the worker to bind the next task to, round-robin.
+func (s *scheduler) worker() *worker {
+	return s.workers[(s.next.Add(1)-1)%uint64(len(s.workers))]
+}
+
+// stop stops all workers, dropping pending events, and waits for them to
+// return.
+func (s *scheduler) stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+type event struct {
+	at    time.Time
+	seq   uint64 // Keeps events scheduled for the same time in order.
+	f     func()
+	index int // In the eventQueue, -1 once removed from it.
+}
+
+// eventQueue is a min-heap of events by time.
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *eventQueue) Push(x any) {
+	e := x.(*event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// worker runs scheduled events one after another.
+type worker struct {
+	mtx   sync.Mutex
+	queue eventQueue
+	seq   uint64
+	wake  chan struct{}
+}
+
+// schedule schedules f to run on w at the given time, or right away if it has
+// passed already. The returned event can be passed to cancel.
+func (w *worker) schedule(at time.Time, f func()) *event {
+	w.mtx.Lock()
+	w.seq++
+	e := &event{at: at, seq: w.seq, f: f}
+	heap.Push(&w.queue, e)
+	first := w.queue[0] == e
+	w.mtx.Unlock()
+	if first {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return e
+}
+
+// cancel removes e from the events scheduled on w, if it has not run yet.
+func (w *worker) cancel(e *event) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if e.index >= 0 {
+		heap.Remove(&w.queue, e.index)
+	}
+}
+
+func (w *worker) run(quit <-chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var due []func()
+	for {
+		due = due[:0]
+		wait := time.Duration(-1)
+		w.mtx.Lock()
+		now := time.Now()
+		for len(w.queue) > 0 && !w.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&w.queue).(*event).f)
+		}
+		if len(w.queue) > 0 {
+			wait = w.queue[0].at.Sub(now)
+		}
+		w.mtx.Unlock()
+		if len(due) > 0 {
+			for _, f := range due {
+				f()
+			}
+			continue
+		}
+
+		var timerC <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			timerC = timer.C
+		}
+		select {
+		case <-quit:
+			return
+		case <-w.wake:
+		case <-timerC:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,1516 @@
+// Package sim simulates rolling restarts of many tasks exposing Prometheus
+// metrics.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Config is the configuration of a Simulator.
+type Config struct {
+	// Num is the number of tasks per batch.
+	Num int
+	// Immortal is the number of tasks, with the ids from 0 up, that are
+	// never restarted. They keep running (and counting) in the initial
+	// batch until the simulation ends.
+	Immortal int
+	// RestartDuration is the duration of a rolling restart.
+	RestartDuration time.Duration
+	// Strategy is how a restart batch replaces the running tasks,
+	// StrategyRolling (the default if empty) or StrategyBlueGreen. With
+	// the latter, RestartDuration and the canary settings are ignored.
+	Strategy string
+	// BGOverlap is the time during which both batches run with
+	// StrategyBlueGreen.
+	BGOverlap time.Duration
+	// Prestart is how the simulation starts, PrestartStaggered (the
+	// default if empty), PrestartUniform, or PrestartNone. The expected
+	// lifetime of the initial tasks is the time within which they crash
+	// with CrashRate or get stuck with StuckRate, and the first restart
+	// batch replaces them accordingly.
+	Prestart string
+	// RestartOverlap is how long a task keeps running in a rolling
+	// restart after its successor has started. If zero, it stops right
+	// before its successor starts, although it still overlaps with it
+	// while draining (see Drain).
+	RestartOverlap time.Duration
+	// RestartOrder is the order in which a rolling restart replaces the
+	// tasks, RestartOrderSequential (the default if empty),
+	// RestartOrderReverse, or RestartOrderRandom.
+	RestartOrder string
+	// ScaleEvents change the number of running tasks at the given times
+	// after the start of the simulation.
+	ScaleEvents []ScaleEvent
+	// CanaryFraction, if positive, makes each rolling restart first
+	// restart ceil(Num*CanaryFraction) tasks as canaries and then wait for
+	// CanaryBake before restarting the remaining tasks.
+	CanaryFraction float64
+	CanaryBake     time.Duration
+	// RunDuration is the duration between restarts (and the initial time
+	// before the first restart).
+	RunDuration time.Duration
+	// QPS is the average number of queries per second per task.
+	QPS float64
+	// Jitter is how much the wait time between queries varies, see
+	// JitterDist.
+	Jitter float64
+	// Loss is the probability of a lost scrape, decided for each task
+	// every LossCheckInterval (default 1s). It is simulated by removing
+	// the metrics of the task for LossDuration (default 1s).
+	Loss              float64
+	LossCheckInterval time.Duration
+	LossDuration      time.Duration
+	// With CorrelatedLoss, the whole exposition fails instead, simulating
+	// failed scrapes of the target.
+	CorrelatedLoss bool
+	// (QPS, Jitter, Loss, and ErrorRate can be changed at runtime, see
+	// SetParams.)
+	// Arrival is the arrival process of queries, ArrivalNormal (the
+	// default if empty) or ArrivalPoisson.
+	Arrival string
+	// JitterDist is the distribution of the jittered wait time between
+	// queries for ArrivalNormal, JitterNormal (the default if empty),
+	// JitterUniform, or JitterLognormal.
+	JitterDist string
+	// QPSAmplitude is the relative amplitude of a sinusoidal variation of
+	// the QPS over time with period QPSPeriod. Zero means no variation.
+	QPSAmplitude float64
+	QPSPeriod    time.Duration
+	// QPSRamp is the relative change of the QPS with each restart batch,
+	// e.g. 0.1 for tasks in batch n to serve 1.1ⁿ times QPS. Zero means
+	// the same QPS for all batches.
+	QPSRamp float64
+	// QPSVariance is the relative standard deviation of the QPS of
+	// individual tasks, each of which keeps the QPS drawn at its start for
+	// its whole lifetime. Zero means the same QPS for all tasks.
+	QPSVariance float64
+	// BurstRate is the probability per second and task of a burst of
+	// BurstSize queries served at once. With BurstSync, all tasks burst
+	// during the same seconds.
+	BurstRate float64
+	BurstSize int
+	BurstSync bool
+	// Warmup is the time after the start of each task during which its QPS
+	// ramps up linearly from 10% to the full QPS. Zero means no warmup.
+	Warmup time.Duration
+	// Deterministic removes the randomness from the timing of queries
+	// (ignoring Jitter and Arrival, with the first query of a task halfway
+	// through the first wait) and from the decisions about failed queries
+	// and lost scrapes, which are spread evenly instead (e.g. every tenth
+	// query fails with an ErrorRate of 0.1).
+	Deterministic bool
+	// StartPaused starts the simulation paused, see Pause.
+	StartPaused bool
+	// MaxQueries, if positive, is the number of queries after which a task
+	// stops serving queries (and bursts), keeping its metrics exposed
+	// with their final values until it stops.
+	MaxQueries int
+	// Drain is the time during which the QPS of a task ramps down
+	// linearly to zero before the task stops because it is replaced by
+	// its successor (which it overlaps with, unless PreserveOnRestart is
+	// set) or scaled down. Tasks stopped because the simulation is
+	// canceled do not drain.
+	Drain time.Duration
+
+	// MetricName, MetricNamespace, and MetricSubsystem make up the name of
+	// the query counter. MetricName defaults to queries_total.
+	MetricName      string
+	MetricNamespace string
+	MetricSubsystem string
+	// MetricUnit is the unit of the query counter, which its name has to
+	// end in (before _total). It requires EnableOpenMetrics.
+	MetricUnit string
+	// MetricHelp is the help text of the query counter, "Number of
+	// (simulated) queries the task has served." if empty. Help overrides
+	// the help texts of the other metrics of the simulated tasks by metric
+	// name, without namespace and subsystem.
+	MetricHelp string
+	Help       map[string]string
+
+	// Labels are added as const labels to all metrics of the simulated
+	// tasks.
+	Labels map[string]string
+	// Model is how the tasks are presented in the exposition,
+	// ModelThreads (the default if empty) or ModelProcess.
+	Model string
+	// UTF8Names allows any UTF-8 string as the name of the query counter
+	// and of the labels, e.g. with dots or spaces. They are exposed
+	// quoted to scrapes with escaping=allow-utf-8 in their Accept header
+	// (or without any Accept header), and escaped to all others.
+	UTF8Names bool
+	// TaskInfo enables a task_info metric per task with the labels
+	// version (TaskInfoVersion), zone (one of TaskInfoZones by task id),
+	// and commit (derived from the version).
+	TaskInfo        bool
+	TaskInfoVersion string
+	TaskInfoZones   []string
+	// VersionRollout gives each restart batch a new version, counting up
+	// from TaskInfoVersion for the initial batch.
+	VersionRollout bool
+	// VersionLabel adds the version as a label to the query counter.
+	VersionLabel bool
+	// BatchLabel and TaskLabel are the names of the labels identifying the
+	// batch and the task. They default to batch and task.
+	BatchLabel string
+	TaskLabel  string
+
+	// ExtraCounters is the number of additional counters per task, each
+	// increasing by its own amount with each query.
+	ExtraCounters int
+
+	// Churn enables a counter with a path label whose values rotate through
+	// a pool of ChurnCardinality random strings, so that series are
+	// created and abandoned over time. Series not incremented for ChurnTTL
+	// are deleted.
+	Churn            bool
+	ChurnCardinality int
+	ChurnTTL         time.Duration
+
+	// Histogram enables a histogram of simulated query latencies with the
+	// given buckets (prometheus.DefBuckets if nil).
+	Histogram        bool
+	HistogramBuckets []float64
+	// NativeHistogram makes the histogram a native histogram with the given
+	// bucket factor and maximum number of buckets. It implies Histogram.
+	// Unless NativeHistogramOnly is set, the classic buckets are exposed,
+	// too.
+	NativeHistogram                bool
+	NativeHistogramOnly            bool
+	NativeHistogramBucketFactor    float64
+	NativeHistogramMaxBucketNumber uint32
+	// Summary enables a summary of simulated query latencies with the
+	// given quantile objectives instead of a histogram.
+	Summary           bool
+	SummaryObjectives map[float64]float64
+	// LatencyMean is the mean of the exponentially distributed simulated
+	// query latency in seconds.
+	LatencyMean float64
+	// Gauge enables a gauge of in-flight queries, each of which is in
+	// flight for an exponentially distributed time with mean ServiceTime.
+	Gauge       bool
+	ServiceTime time.Duration
+	// Uptime enables a gauge of the time since the task has started.
+	Uptime bool
+	// RandomWalk enables a gauge that starts at a random value between
+	// RandomWalkMin and RandomWalkMax and changes by a random amount of up
+	// to ±RandomWalkStep with each query, clamped to the same range.
+	RandomWalk     bool
+	RandomWalkStep float64
+	RandomWalkMin  float64
+	RandomWalkMax  float64
+	// ErrorRate is the relative amount of failed queries. If non-zero,
+	// queries_total gets a status label.
+	ErrorRate float64
+	// SpuriousResetRate is the probability per second to reset the query
+	// counter of a task in place to a random lower value, simulating a
+	// buggy exporter.
+	SpuriousResetRate float64
+	// RoleFlipRate is the probability per second that a task flips the
+	// role label of its query counter to another one of Roles (leader
+	// and follower if empty), so that the counter continues as a new
+	// series while the old one goes stale. Zero means no role label.
+	RoleFlipRate float64
+	Roles        []string
+	// SpecialFloats enables a gauge debug_value that is set every second
+	// to a random value, or with probability SpecialFloatRate to NaN,
+	// +Inf, or -Inf.
+	SpecialFloats    bool
+	SpecialFloatRate float64
+	// MemGrowth, if positive, enables a gauge of the resident memory of
+	// each task, starting at MemBaseline and growing by MemGrowth bytes
+	// per second (with some noise) until the task restarts.
+	MemGrowth   float64
+	MemBaseline float64
+	// Increment is the amount each query adds to the query counter
+	// (default 1). With IncrementJitter, a uniformly distributed random
+	// amount between -IncrementJitter and +IncrementJitter is added to it,
+	// which must keep the increment positive.
+	Increment       float64
+	IncrementJitter float64
+	// CounterStart is the initial value of the query counter of each task.
+	// If CounterStartMax is positive, the initial value is a random integer
+	// between 0 and CounterStartMax instead. A non-zero start value still
+	// looks like a counter reset on restart unless PreserveOnRestart is set.
+	CounterStart    float64
+	CounterStartMax float64
+	// PreserveOnRestart makes a restarted task start its counter with the
+	// final value of the most recently stopped task with the same id.
+	PreserveOnRestart bool
+	// ExplicitStaleness makes the counters and gauges of a stopped task
+	// stay in the exposition for one more scrape, with a stale marker as
+	// their value, so that Prometheus marks them as stale right away.
+	// Histograms and summaries simply vanish. Only the protobuf format
+	// preserves the stale marker, the text formats turn it into a plain
+	// NaN.
+	ExplicitStaleness bool
+	// BatchRegistries registers the metrics of the tasks of each restart
+	// batch with a registry of its own, so that they can also be exposed
+	// per batch, see BatchHandler. The registry of a batch is dropped once
+	// all its tasks have stopped.
+	BatchRegistries bool
+
+	// PaddingSeries is the number of rrsim_padding gauges with long label
+	// values added to the exposition to inflate its size. Alternatively,
+	// TargetScrapeSize is the approximate number of bytes the padding
+	// series are to add to the text exposition.
+	PaddingSeries    int
+	TargetScrapeSize int
+	// IncludeGoMetrics adds the metrics of the Go and process collectors
+	// to the exposed metrics.
+	IncludeGoMetrics bool
+	// InstrumentHandler adds the promhttp_metric_handler_* metrics about
+	// the scrapes of the metrics endpoint to the exposed metrics.
+	InstrumentHandler bool
+	// EnableOpenMetrics enables the OpenMetrics exposition format. It also
+	// makes the metrics of the simulated tasks with a unit in their name,
+	// like query_duration_seconds, declare that unit.
+	EnableOpenMetrics bool
+	// EnableOpenMetricsCreated adds _created samples to the OpenMetrics
+	// exposition. As each task creates its metrics when it starts, a
+	// restarted task exposes a newer created timestamp.
+	EnableOpenMetricsCreated bool
+	// ForceGzip makes the metrics endpoint gzip-compress all responses,
+	// whatever the Accept-Encoding header of the request says.
+	// DisableCompression makes it never compress them.
+	ForceGzip          bool
+	DisableCompression bool
+	// DefaultFormat is the exposition format used if a scrape does not
+	// ask for any specific one in its Accept header: FormatText (the
+	// default if empty), FormatOpenMetrics (requires EnableOpenMetrics),
+	// or FormatProtobuf. Otherwise, the format is negotiated as usual.
+	DefaultFormat string
+	// Exemplars attaches exemplars with a random trace_id to the given
+	// fraction of increments of queries_total. Only effective if
+	// EnableOpenMetrics is set.
+	Exemplars    bool
+	ExemplarRate float64
+	// TimestampSkew, if non-zero, makes all samples of the simulated tasks
+	// carry an explicit timestamp offset by that much from the current
+	// time (negative for clocks running behind).
+	TimestampSkew time.Duration
+	// OutOfOrderRate is the probability per scrape and task to expose
+	// queries_total with a timestamp OutOfOrderAge (default 1m) in the
+	// past, i.e. out of order if OutOfOrderAge is longer than the scrape
+	// interval. Otherwise, samples keep their usual timestamp (if any, see
+	// TimestampSkew).
+	OutOfOrderRate float64
+	OutOfOrderAge  time.Duration
+	// PartialLoss enables dropping the given fraction of random metric
+	// families (other than the rrsim_* self-metrics) from each scrape.
+	PartialLoss         bool
+	PartialLossFraction float64
+
+	// Pushgateway is the URL of a Pushgateway to push the metrics of each
+	// task to every PushInterval and once more when the task stops, using
+	// the given Job and the batch and task labels as grouping key. If
+	// PushDeleteOnStop is set, the pushed metrics are deleted again after
+	// the final push. The metrics are exposed via Handler regardless.
+	Pushgateway      string
+	PushInterval     time.Duration
+	Job              string
+	PushDeleteOnStop bool
+	// RemoteWriteURL is the URL of a remote-write receiver to send all the
+	// metrics exposed via Handler to every RemoteWriteInterval (default
+	// 15s), with Job as the job label. The metrics are exposed via Handler
+	// regardless.
+	RemoteWriteURL      string
+	RemoteWriteInterval time.Duration
+
+	// CrashRate is the relative amount of tasks that crash at a random time
+	// during their lifetime rather than running until the end of it. If
+	// CrashHang is positive, a crashing task hangs for that long before
+	// it is gone, i.e. it keeps exposing its metrics without updating
+	// them.
+	CrashRate float64
+	CrashHang time.Duration
+	// StuckRate is the relative amount of tasks that get stuck at a random
+	// time during their lifetime: They stop serving queries, so that
+	// their counters stay flat, but keep exposing their metrics until
+	// they are replaced by the next restart batch.
+	StuckRate float64
+
+	// MaxRestarts, if positive, is the number of restart batches after
+	// which Run returns once all tasks have stopped.
+	MaxRestarts int
+	// MaxDuration, if positive, is the time after which Run stops all tasks
+	// and returns.
+	MaxDuration time.Duration
+	// ShutdownTimeout is the maximum time Run waits for running tasks to
+	// stop.
+	ShutdownTimeout time.Duration
+	// Workers is the number of goroutines running the events of all tasks
+	// (runtime.GOMAXPROCS if not positive).
+	Workers int
+
+	// Version and Revision are the version and the VCS revision of rrsim
+	// reported by the rrsim_build_info metric.
+	Version  string
+	Revision string
+
+	// Logger is used for all logging. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// Seed is the seed for all randomness of the simulation. If 0, the
+	// current time is used.
+	Seed int64
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// validMetricName returns whether name is a valid metric name, which is any
+// non-empty UTF-8 string with UTF8Names.
+func (cfg Config) validMetricName(name string) bool {
+	if cfg.UTF8Names {
+		return name != "" && utf8.ValidString(name)
+	}
+	return metricNameRE.MatchString(name)
+}
+
+// validLabelName returns whether name is a valid label name, which is any
+// non-empty UTF-8 string with UTF8Names.
+func (cfg Config) validLabelName(name string) bool {
+	if cfg.UTF8Names {
+		return name != "" && utf8.ValidString(name)
+	}
+	return labelNameRE.MatchString(name)
+}
+
+// ScaleEvent is a change of the number of tasks by Delta at time At.
+type ScaleEvent struct {
+	At    time.Duration
+	Delta int
+}
+
+// Arrival processes of queries.
+const (
+	// ArrivalNormal is normal-distributed wait times between queries with
+	// σ/μ = Jitter.
+	ArrivalNormal = "normal"
+	// ArrivalPoisson is a Poisson process, i.e. exponentially distributed
+	// wait times between queries. Jitter is ignored.
+	ArrivalPoisson = "poisson"
+)
+
+// Restart strategies.
+const (
+	// StrategyRolling replaces one task after the other, spread over
+	// RestartDuration.
+	StrategyRolling = "rolling"
+	// StrategyBlueGreen starts all tasks of the new batch at once and
+	// stops all tasks of the old batch BGOverlap later.
+	StrategyBlueGreen = "blue-green"
+)
+
+// Exposition formats.
+const (
+	FormatText        = "text"
+	FormatOpenMetrics = "openmetrics"
+	FormatProtobuf    = "protobuf"
+)
+
+// formatAccept is the Accept header requesting each exposition format.
+var formatAccept = map[string]string{
+	FormatText:        "text/plain;version=0.0.4",
+	FormatOpenMetrics: "application/openmetrics-text;version=1.0.0",
+	FormatProtobuf:    "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+}
+
+// Models of the tasks.
+const (
+	// ModelThreads presents the tasks as parts of one process, only
+	// distinguished by the batch and task labels.
+	ModelThreads = "threads"
+	// ModelProcess presents the tasks as separate processes behind one
+	// endpoint, with an instance label of the form host:port (derived
+	// from the task id) on all their metrics.
+	ModelProcess = "process"
+)
+
+// Ways to start a simulation.
+const (
+	// PrestartStaggered starts with a batch of tasks that have been
+	// running for a while already, each expected to live until it is
+	// replaced by the first restart batch.
+	PrestartStaggered = "staggered"
+	// PrestartUniform starts with a batch of fresh tasks, all expected to
+	// live for RunDuration. The first restart batch replaces all of them
+	// at once.
+	PrestartUniform = "uniform"
+	// PrestartNone starts without any tasks until the first restart
+	// batch.
+	PrestartNone = "none"
+)
+
+// Orders of the tasks in a rolling restart.
+const (
+	// RestartOrderSequential replaces the tasks by ascending id.
+	RestartOrderSequential = "sequential"
+	// RestartOrderReverse replaces the tasks by descending id.
+	RestartOrderReverse = "reverse"
+	// RestartOrderRandom replaces the tasks in a random order, shuffled
+	// anew for each restart batch.
+	RestartOrderRandom = "random"
+)
+
+// Distributions of the jittered wait time between queries.
+const (
+	// JitterNormal is normal-distributed with σ/μ = Jitter.
+	JitterNormal = "normal"
+	// JitterUniform is uniformly distributed in [μ(1-Jitter), μ(1+Jitter)].
+	JitterUniform = "uniform"
+	// JitterLognormal is log-normal-distributed, with Jitter as the σ of
+	// the underlying normal distribution.
+	JitterLognormal = "lognormal"
+)
+
+// Validate returns an error if cfg cannot be used to create a Simulator. All
+// numeric settings out of their bounds are reported at once, as an error
+// created by errors.Join.
+func (cfg Config) Validate() error {
+	if errs := cfg.numberErrors(); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	name := cfg.MetricName
+	if name == "" {
+		name = defaultMetricName
+	}
+	fqName := prometheus.BuildFQName(cfg.MetricNamespace, cfg.MetricSubsystem, name)
+	if !cfg.validMetricName(fqName) {
+		return fmt.Errorf("invalid metric name %q", fqName)
+	}
+	if cfg.MetricUnit != "" {
+		if !cfg.EnableOpenMetrics {
+			return errors.New("a metric unit requires enabling OpenMetrics")
+		}
+		if !strings.HasSuffix(strings.TrimSuffix(fqName, "_total"), "_"+cfg.MetricUnit) {
+			return fmt.Errorf("metric name %q does not end in its unit %q", fqName, cfg.MetricUnit)
+		}
+	}
+	if cfg.Churn && (cfg.ChurnCardinality <= 0 || cfg.ChurnTTL <= 0) {
+		return errors.New("churn requires positive cardinality and TTL")
+	}
+	switch cfg.Arrival {
+	case "", ArrivalNormal, ArrivalPoisson:
+	default:
+		return fmt.Errorf("unknown arrival process %q", cfg.Arrival)
+	}
+	if cfg.Summary && (cfg.Histogram || cfg.NativeHistogram || cfg.NativeHistogramOnly) {
+		return errors.New("summary and histogram are mutually exclusive")
+	}
+	for q, e := range cfg.SummaryObjectives {
+		if !(q >= 0 && q <= 1) || !(e >= 0 && e <= 1) {
+			return fmt.Errorf("invalid summary objective %v:%v", q, e)
+		}
+	}
+	switch cfg.Strategy {
+	case "", StrategyRolling:
+	case StrategyBlueGreen:
+		if cfg.PreserveOnRestart {
+			return errors.New("preserving counters on restart requires the rolling strategy")
+		}
+	default:
+		return fmt.Errorf("unknown restart strategy %q", cfg.Strategy)
+	}
+	switch cfg.Model {
+	case "", ModelThreads, ModelProcess:
+	default:
+		return fmt.Errorf("unknown model %q", cfg.Model)
+	}
+	switch cfg.Prestart {
+	case "", PrestartStaggered, PrestartUniform, PrestartNone:
+	default:
+		return fmt.Errorf("unknown prestart mode %q", cfg.Prestart)
+	}
+	switch cfg.RestartOrder {
+	case "", RestartOrderSequential, RestartOrderReverse, RestartOrderRandom:
+	default:
+		return fmt.Errorf("unknown restart order %q", cfg.RestartOrder)
+	}
+	if cfg.RestartOverlap > 0 && cfg.PreserveOnRestart {
+		return errors.New("preserving counters on restart requires a restart overlap of zero")
+	}
+	if cfg.RoleFlipRate > 0 {
+		if cfg.ExplicitStaleness {
+			return errors.New("role flips and explicit staleness are mutually exclusive")
+		}
+		if len(cfg.Roles) == 1 {
+			return errors.New("role flips require at least two roles")
+		}
+		seen := map[string]bool{}
+		for _, r := range cfg.Roles {
+			if r == "" || seen[r] {
+				return fmt.Errorf("roles must be non-empty and distinct, got %q", cfg.Roles)
+			}
+			seen[r] = true
+		}
+	}
+	if cfg.ForceGzip && cfg.DisableCompression {
+		return errors.New("forcing gzip and disabling compression are mutually exclusive")
+	}
+	switch cfg.DefaultFormat {
+	case "", FormatText, FormatProtobuf:
+	case FormatOpenMetrics:
+		if !cfg.EnableOpenMetrics {
+			return errors.New("OpenMetrics as default format requires enabling OpenMetrics")
+		}
+	default:
+		return fmt.Errorf("unknown exposition format %q", cfg.DefaultFormat)
+	}
+	if cfg.PaddingSeries > 0 && cfg.TargetScrapeSize > 0 {
+		return errors.New("padding series and target scrape size are mutually exclusive")
+	}
+	if cfg.Immortal > 0 && cfg.Prestart == PrestartNone {
+		return errors.New("immortal tasks require starting an initial batch")
+	}
+	switch cfg.JitterDist {
+	case "", JitterNormal, JitterUniform, JitterLognormal:
+	default:
+		return fmt.Errorf("unknown jitter distribution %q", cfg.JitterDist)
+	}
+	batchLabel, taskLabel := cfg.batchTaskLabels()
+	reserved := cfg.reservedLabels()
+	for _, name := range []string{batchLabel, taskLabel} {
+		if !cfg.validLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if reserved[name] {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+	if batchLabel == taskLabel {
+		return fmt.Errorf("batch and task label are both named %q", batchLabel)
+	}
+	for name := range cfg.Help {
+		if !cfg.validMetricName(name) {
+			return fmt.Errorf("invalid metric name %q for help text", name)
+		}
+	}
+	reserved[batchLabel], reserved[taskLabel] = true, true
+	for name := range cfg.Labels {
+		if !cfg.validLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if reserved[name] {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// numberErrors returns an error for each numeric setting of cfg that is out of
+// its bounds, so that all of them can be reported at once.
+func (cfg Config) numberErrors() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(cfg.Num > 0, "number of tasks must be positive, got %d", cfg.Num)
+	check(cfg.Immortal >= 0 && cfg.Immortal <= max(cfg.Num, 0), "number of immortal tasks must be between 0 and %d, got %d", max(cfg.Num, 0), cfg.Immortal)
+	check(cfg.RunDuration > 0, "run duration must be positive, got %v", cfg.RunDuration)
+	if err := (Params{QPS: cfg.QPS, Jitter: cfg.Jitter, Loss: cfg.Loss, ErrorRate: cfg.ErrorRate}).Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"restart duration", cfg.RestartDuration},
+		{"restart overlap", cfg.RestartOverlap},
+		{"blue-green overlap", cfg.BGOverlap},
+		{"canary bake", cfg.CanaryBake},
+		{"warmup", cfg.Warmup},
+		{"drain", cfg.Drain},
+		{"service time", cfg.ServiceTime},
+		{"QPS period", cfg.QPSPeriod},
+		{"loss check interval", cfg.LossCheckInterval},
+		{"loss duration", cfg.LossDuration},
+		{"out-of-order age", cfg.OutOfOrderAge},
+		{"remote-write interval", cfg.RemoteWriteInterval},
+		{"crash hang", cfg.CrashHang},
+		{"maximum duration", cfg.MaxDuration},
+		{"shutdown timeout", cfg.ShutdownTimeout},
+	} {
+		check(d.d >= 0, "%s must not be negative, got %v", d.name, d.d)
+	}
+	for _, r := range []struct {
+		name string
+		r    float64
+	}{
+		{"canary fraction", cfg.CanaryFraction},
+		{"burst rate", cfg.BurstRate},
+		{"spurious reset rate", cfg.SpuriousResetRate},
+		{"role flip rate", cfg.RoleFlipRate},
+		{"special float rate", cfg.SpecialFloatRate},
+		{"exemplar rate", cfg.ExemplarRate},
+		{"out-of-order rate", cfg.OutOfOrderRate},
+		{"partial loss fraction", cfg.PartialLossFraction},
+		{"crash rate", cfg.CrashRate},
+		{"stuck rate", cfg.StuckRate},
+	} {
+		check(r.r >= 0 && r.r <= 1, "%s must be between 0 and 1, got %v", r.name, r.r)
+	}
+	for _, n := range []struct {
+		name string
+		n    int
+	}{
+		{"burst size", cfg.BurstSize},
+		{"maximum number of queries", cfg.MaxQueries},
+		{"number of extra counters", cfg.ExtraCounters},
+		{"number of padding series", cfg.PaddingSeries},
+		{"target scrape size", cfg.TargetScrapeSize},
+	} {
+		check(n.n >= 0, "%s must not be negative, got %d", n.name, n.n)
+	}
+	check(cfg.PushInterval > 0 || cfg.Pushgateway == "", "push interval must be positive, got %v", cfg.PushInterval)
+	check(cfg.QPSRamp > -1, "QPS ramp must be greater than -1, got %v", cfg.QPSRamp)
+	check(cfg.QPSVariance >= 0, "QPS variance must not be negative, got %v", cfg.QPSVariance)
+	check(cfg.LatencyMean >= 0, "latency mean must not be negative, got %v", cfg.LatencyMean)
+	check(cfg.MemGrowth >= 0 && cfg.MemBaseline >= 0, "memory growth and baseline must not be negative")
+	check(cfg.CounterStart >= 0 && cfg.CounterStartMax >= 0, "counter start values must not be negative")
+	check(cfg.RandomWalkStep >= 0, "random walk step must not be negative, got %v", cfg.RandomWalkStep)
+	check(cfg.RandomWalkMin <= cfg.RandomWalkMax, "random walk minimum %v is above the maximum %v", cfg.RandomWalkMin, cfg.RandomWalkMax)
+	increment := cfg.Increment
+	if increment == 0 {
+		increment = 1
+	}
+	check(increment > 0, "increment must be positive, got %v", cfg.Increment)
+	check(cfg.IncrementJitter >= 0 && cfg.IncrementJitter < increment, "increment jitter must be between 0 and the increment (%v), got %v", increment, cfg.IncrementJitter)
+	return errs
+}
+
+// batchTaskLabels returns the names of the batch and task labels, with the
+// defaults applied.
+func (cfg Config) batchTaskLabels() (batch, task string) {
+	batch, task = cfg.BatchLabel, cfg.TaskLabel
+	if batch == "" {
+		batch = defaultBatchLabel
+	}
+	if task == "" {
+		task = defaultTaskLabel
+	}
+	return batch, task
+}
+
+// reservedLabels returns the label names used by the Simulator itself, apart
+// from the batch and task labels.
+func (cfg Config) reservedLabels() map[string]bool {
+	reserved := map[string]bool{}
+	if cfg.Histogram || cfg.NativeHistogram || cfg.NativeHistogramOnly {
+		reserved["le"] = true
+	}
+	if cfg.Summary {
+		reserved["quantile"] = true
+	}
+	if cfg.ErrorRate > 0 {
+		reserved["status"] = true
+	}
+	if cfg.Churn {
+		reserved["path"] = true
+	}
+	if cfg.RoleFlipRate > 0 {
+		reserved["role"] = true
+	}
+	if cfg.Model == ModelProcess {
+		reserved["instance"] = true
+	}
+	if cfg.RemoteWriteURL != "" {
+		reserved["job"] = true
+	}
+	if cfg.TaskInfo || cfg.VersionLabel {
+		reserved["version"] = true
+	}
+	if cfg.TaskInfo {
+		reserved["zone"] = true
+		reserved["commit"] = true
+	}
+	return reserved
+}
+
+const (
+	defaultMetricName = "queries_total"
+	defaultMetricHelp = "Number of (simulated) queries the task has served."
+	defaultBatchLabel = "batch"
+	defaultTaskLabel  = "task"
+)
+
+// Simulator runs the simulated tasks.
+type Simulator struct {
+	cfg      Config
+	log      *slog.Logger
+	reg      *prometheus.Registry
+	gatherer prometheus.Gatherer
+	tasks    *taskSet
+	sched    *scheduler
+	// scrapeGatherer is gatherer plus the stale markers for Handler.
+	scrapeGatherer prometheus.Gatherer
+
+	// mtx protects the current number of tasks and the number of the most
+	// recent restart batch, which change by scaling and restarting.
+	mtx     sync.Mutex
+	num     int
+	batch   int
+	metrics *selfMetrics
+	start   time.Time
+	ready   atomic.Bool
+	params  atomic.Pointer[Params]
+	// firstStarted is closed by firstStart once the metrics of the first
+	// task are registered.
+	firstStarted chan struct{}
+	firstStart   func()
+	// scrapeLost is set while all scrapes fail for CorrelatedLoss.
+	scrapeLost atomic.Bool
+	pause      *pauseState
+
+	// restartRequests is received from by Run while no restart batch is
+	// in progress. The batch number of the triggered restart is sent to
+	// the received channel. finished is closed once Run returns.
+	restartRequests chan chan<- int
+	finished        chan struct{}
+
+	// carriedValues holds the final counter values of stopped tasks by
+	// task id for PreserveOnRestart. The inner map is keyed by the value
+	// of the status label (empty if there is none).
+	carriedValues    map[int]map[string]float64
+	carriedValuesMtx sync.Mutex
+	// events are sent to the subscribers, see Subscribe.
+	events *broadcaster
+	// staleMarkers is nil unless ExplicitStaleness is set.
+	staleMarkers *staleMarkers
+	// batchRegs holds the registries of the live batches by batch number
+	// for BatchRegistries.
+	batchRegs    map[int]*batchRegistry
+	batchRegsMtx sync.Mutex
+}
+
+// New returns a Simulator for the given configuration. Each Simulator has its
+// own registry for the metrics of its simulated tasks, so that more than one
+// can exist in the same process.
+func New(cfg Config) *Simulator {
+	if cfg.NativeHistogramOnly {
+		cfg.NativeHistogram = true
+	}
+	if cfg.NativeHistogram {
+		cfg.Histogram = true
+	}
+	if cfg.MetricName == "" {
+		cfg.MetricName = defaultMetricName
+	}
+	if cfg.MetricHelp == "" {
+		cfg.MetricHelp = defaultMetricHelp
+	}
+	cfg.BatchLabel, cfg.TaskLabel = cfg.batchTaskLabels()
+	cfg.ScaleEvents = slices.Clone(cfg.ScaleEvents)
+	sort.SliceStable(cfg.ScaleEvents, func(i, j int) bool {
+		return cfg.ScaleEvents[i].At < cfg.ScaleEvents[j].At
+	})
+	if len(cfg.Roles) == 0 {
+		cfg.Roles = []string{"leader", "follower"}
+	}
+	if len(cfg.TaskInfoZones) == 0 {
+		cfg.TaskInfoZones = []string{""}
+	}
+	if cfg.OutOfOrderAge <= 0 {
+		cfg.OutOfOrderAge = time.Minute
+	}
+	if cfg.Increment <= 0 {
+		cfg.Increment = 1
+	}
+	if cfg.LossCheckInterval <= 0 {
+		cfg.LossCheckInterval = time.Second
+	}
+	if cfg.LossDuration <= 0 {
+		cfg.LossDuration = time.Second
+	}
+	if cfg.RemoteWriteInterval <= 0 {
+		cfg.RemoteWriteInterval = defaultRemoteWriteInterval
+	}
+	if cfg.HistogramBuckets == nil {
+		cfg.HistogramBuckets = prometheus.DefBuckets
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	cfg.Logger.Info("Using seed", "seed", cfg.Seed)
+	reg := prometheus.NewRegistry()
+	if cfg.IncludeGoMetrics {
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	s := &Simulator{
+		cfg:           cfg,
+		log:           cfg.Logger,
+		reg:           reg,
+		gatherer:      reg,
+		tasks:         newTaskSet(),
+		metrics:       newSelfMetrics(reg, cfg.Version, cfg.Revision),
+		start:         time.Now(),
+		carriedValues: map[int]map[string]float64{},
+
+		restartRequests: make(chan chan<- int),
+		finished:        make(chan struct{}),
+		pause:           newPauseState(cfg.StartPaused),
+		events:          newBroadcaster(),
+		firstStarted:    make(chan struct{}),
+	}
+	s.firstStart = sync.OnceFunc(func() { close(s.firstStarted) })
+	if cfg.BatchRegistries {
+		s.batchRegs = map[int]*batchRegistry{}
+		s.gatherer = prometheus.GathererFunc(s.gatherBatches)
+	}
+	if cfg.PartialLoss {
+		s.gatherer = &lossyGatherer{
+			Gatherer: s.gatherer,
+			fraction: cfg.PartialLossFraction,
+			rng:      rand.New(rand.NewSource(cfg.Seed)),
+		}
+	}
+	if cfg.TargetScrapeSize > 0 {
+		s.cfg.PaddingSeries = paddingSeriesFor(cfg.TargetScrapeSize)
+		s.log.Info("Adding padding series", "series", s.cfg.PaddingSeries, "target_scrape_size", cfg.TargetScrapeSize)
+	}
+	if s.cfg.PaddingSeries > 0 {
+		reg.MustRegister(newPaddingCollector(s.cfg.PaddingSeries))
+	}
+	if cfg.ExplicitStaleness {
+		s.staleMarkers = newStaleMarkers()
+	}
+	s.scrapeGatherer = s.withStaleMarkers(s.gatherer)
+	s.params.Store(&Params{QPS: cfg.QPS, Jitter: cfg.Jitter, Loss: cfg.Loss, ErrorRate: cfg.ErrorRate})
+	return s
+}
+
+// Handler returns an http.Handler exposing the metrics of the simulated tasks.
+// The protobuf format, which is required to expose native histograms, is
+// negotiated as usual (see DefaultFormat for scrapes not asking for any), and
+// so is the compression unless ForceGzip or DisableCompression is set. With
+// BatchRegistries, the metrics of all live batches are exposed.
+func (s *Simulator) Handler() http.Handler {
+	return s.handlerFor(s.scrapeGatherer)
+}
+
+// withStaleMarkers returns a Gatherer for the metrics gathered by g along with
+// the stale markers not yet gathered by it if ExplicitStaleness is set. Each
+// call returns a Gatherer consuming its own copy of the stale markers.
+func (s *Simulator) withStaleMarkers(g prometheus.Gatherer) prometheus.Gatherer {
+	if s.staleMarkers == nil {
+		return g
+	}
+	return s.staleMarkers.gatherer(g)
+}
+
+// handlerFor returns the http.Handler exposing the metrics gathered by g as
+// described for Handler.
+func (s *Simulator) handlerFor(g prometheus.Gatherer) http.Handler {
+	var h http.Handler = promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		EnableOpenMetrics:                   s.cfg.EnableOpenMetrics,
+		EnableOpenMetricsTextCreatedSamples: s.cfg.EnableOpenMetricsCreated,
+		DisableCompression:                  s.cfg.DisableCompression,
+	})
+	// With UTF8Names, scrapes not asking for any format get the default one
+	// with the names unescaped, unlike what the negotiation would pick.
+	if s.cfg.DefaultFormat != "" || s.cfg.UTF8Names {
+		format := s.cfg.DefaultFormat
+		if format == "" {
+			format = FormatText
+		}
+		next, accept := h, formatAccept[format]
+		if s.cfg.UTF8Names {
+			accept += ";escaping=allow-utf-8"
+		}
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !asksForFormat(r.Header.Values("Accept")) {
+				r = r.Clone(r.Context())
+				r.Header.Set("Accept", accept)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	if s.cfg.ForceGzip {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Pretend the scraper only accepts gzip.
+			r = r.Clone(r.Context())
+			r.Header.Set("Accept-Encoding", "gzip")
+			next.ServeHTTP(w, r)
+		})
+	}
+	if s.cfg.CorrelatedLoss {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.scrapeLost.Load() {
+				http.Error(w, "simulated scrape loss", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	next := h
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		s.metrics.scrapeDuration.Observe(time.Since(start).Seconds())
+	})
+	if s.cfg.InstrumentHandler {
+		// Also counts the scrapes failed by CorrelatedLoss.
+		h = promhttp.InstrumentMetricHandler(s.reg, h)
+	}
+	return h
+}
+
+// asksForFormat returns whether the given Accept headers name any of the
+// exposition formats, rather than e.g. just */*.
+func asksForFormat(accept []string) bool {
+	for _, a := range accept {
+		for _, prefix := range []string{"text/plain", "application/openmetrics-text", "application/vnd.google.protobuf"} {
+			if strings.Contains(a, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ready returns whether the metrics of the first batch of tasks (or, with
+// PrestartNone, of the first task) are registered and the simulation is not
+// stopping.
+func (s *Simulator) Ready() bool {
+	return s.ready.Load()
+}
+
+// Run runs the simulation until ctx is done, MaxDuration has passed, or all
+// tasks have stopped after MaxRestarts restart batches. It returns an error if
+// not all tasks stopped within ShutdownTimeout.
+func (s *Simulator) Run(ctx context.Context) error {
+	defer close(s.finished)
+	defer s.events.close()
+	if s.cfg.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.MaxDuration)
+		defer cancel()
+	}
+	s.start = time.Now()
+	s.sched = newScheduler(s.cfg.Workers)
+	defer s.sched.stop()
+	if s.cfg.CorrelatedLoss {
+		// Run may return before ctx is done.
+		lossCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.loseScrapes(lossCtx)
+	}
+	if s.cfg.RemoteWriteURL != "" {
+		writeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.remoteWrite(writeCtx)
+	}
+	num := s.cfg.Num
+	batch := 0
+	s.mtx.Lock()
+	s.num = num
+	s.mtx.Unlock()
+
+	// First start one batch of tasks, unless Prestart is PrestartNone.
+	var initial sync.WaitGroup
+	if s.cfg.Prestart != PrestartNone {
+		initial.Add(num)
+		pos := make([]int, num) // In the order of the first restart batch.
+		for i, id := range s.restartOrder(1, num) {
+			pos[id] = i
+		}
+		for id := 0; id < num; id++ {
+			d := s.cfg.RunDuration
+			if s.cfg.Prestart != PrestartUniform {
+				d += s.restartOffset(pos[id], num) + s.cfg.RestartOverlap
+			}
+			s.startTask(ctx, id, batch, d, initial.Done)
+		}
+	}
+	go func() {
+		initial.Wait()
+		// With PrestartNone, there is nothing to be ready for before the
+		// first restart batch (or scaling) starts a task.
+		select {
+		case <-s.firstStarted:
+		case <-ctx.Done():
+		}
+		if ctx.Err() == nil {
+			s.ready.Store(true)
+		}
+	}()
+	scaleCtx, stopScaling := context.WithCancel(ctx)
+	scaled := make(chan struct{})
+	go func() {
+		defer close(scaled)
+		s.runScaleEvents(scaleCtx, ctx)
+	}()
+
+	for s.cfg.MaxRestarts <= 0 || batch < s.cfg.MaxRestarts {
+		reply, ok := s.waitForRestart(ctx)
+		if !ok {
+			break
+		}
+		batch++
+		if reply != nil {
+			reply <- batch
+		}
+		if !s.restart(ctx, batch) {
+			break
+		}
+	}
+	stopScaling()
+	<-scaled
+	if ctx.Err() == nil {
+		s.log.Info("All restart batches initiated, stopping tasks after the run duration", "batches", batch)
+		if s.sleep(ctx, s.cfg.RunDuration) {
+			s.mtx.Lock()
+			num := s.num
+			s.mtx.Unlock()
+			stop := func(_, id int) func() {
+				s.tasks.stop(id, math.MaxInt)
+				return nil
+			}
+			if s.cfg.Strategy == StrategyBlueGreen {
+				for id := 0; id < num; id++ {
+					stop(0, id)
+				}
+			} else {
+				s.roll(ctx, batch+1, num, stop)
+			}
+		}
+		s.tasks.wait(ctx)
+	}
+
+	s.log.Info("Stopping simulation")
+	s.ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if left := s.tasks.wait(shutdownCtx); len(left) > 0 {
+		for _, k := range left {
+			s.log.Error("Task did not stop in time", "task", k.id, "batch", k.batch)
+		}
+		return fmt.Errorf("%d tasks did not stop within %v", len(left), s.cfg.ShutdownTimeout)
+	}
+	return nil
+}
+
+// waitForRestart waits for RunDuration (not counting pauses) or a restart
+// request, whichever comes first, and returns the channel to reply to in the
+// latter case. It returns false if ctx is done first.
+func (s *Simulator) waitForRestart(ctx context.Context) (chan<- int, bool) {
+	return s.sleepOrRestart(ctx, s.cfg.RunDuration, s.restartRequests)
+}
+
+// canaries returns the number of canary tasks restarted before the others
+// with num tasks, or 0 if there is no canary phase.
+func (s *Simulator) canaries(num int) int {
+	if s.cfg.CanaryFraction <= 0 || s.cfg.Strategy == StrategyBlueGreen {
+		return 0
+	}
+	c := int(math.Ceil(float64(num) * s.cfg.CanaryFraction))
+	if c >= num {
+		return 0
+	}
+	return c
+}
+
+// restartOffset returns the time after the start of a restart batch of num
+// tasks at which the i-th task in the restart order is replaced by its
+// successor.
+func (s *Simulator) restartOffset(i, num int) time.Duration {
+	if s.cfg.Strategy == StrategyBlueGreen {
+		return s.cfg.BGOverlap
+	}
+	offset := s.cfg.RestartDuration * time.Duration(i) / time.Duration(num)
+	if c := s.canaries(num); c > 0 && i >= c {
+		offset += s.cfg.CanaryBake
+	}
+	return offset
+}
+
+// restartLength returns how long a restart batch of num tasks takes.
+func (s *Simulator) restartLength(num int) time.Duration {
+	if s.cfg.Strategy == StrategyBlueGreen {
+		return s.cfg.BGOverlap
+	}
+	d := s.cfg.RestartDuration
+	if s.canaries(num) > 0 {
+		d += s.cfg.CanaryBake
+	}
+	return d
+}
+
+// cycle returns how long each task of a batch of num tasks runs until it is
+// replaced by its successor in the next batch, i.e. the time between the starts
+// of two restart batches plus the overlap with the successor.
+func (s *Simulator) cycle(num int) time.Duration {
+	d := s.cfg.RunDuration + s.restartLength(num)
+	if s.cfg.Strategy != StrategyBlueGreen {
+		d += s.cfg.RestartOverlap
+	}
+	return d
+}
+
+// restart performs a rolling restart of all tasks into the given batch. It
+// returns false if ctx is done before the restart is complete. Each started
+// task replaces its predecessor with the same id.
+func (s *Simulator) restart(ctx context.Context, batch int) bool {
+	s.mtx.Lock()
+	s.batch = batch
+	num := s.num
+	s.mtx.Unlock()
+	s.log.Info("Initiating restart batch", "batch", batch)
+	s.publish(Event{Type: EventBatchStart, Batch: batch})
+	s.metrics.restarts.Inc()
+	s.metrics.currentBatch.Set(float64(batch))
+	s.metrics.restartInProgress.Set(1)
+	s.metrics.restartProgress.Set(0)
+	defer func() {
+		s.metrics.restartInProgress.Set(0)
+		s.metrics.restartProgress.Set(0)
+	}()
+	if s.cfg.Strategy == StrategyBlueGreen {
+		ok := s.switchBatch(ctx, batch)
+		if ok {
+			s.log.Info("Restart batch complete", "batch", batch)
+			s.publish(Event{Type: EventBatchComplete, Batch: batch})
+		}
+		return ok
+	}
+	ok := s.roll(ctx, batch, num, func(i, id int) func() {
+		defer s.metrics.restartProgress.Set(float64(i+1) / float64(num))
+		// Scaling might have started the task already.
+		if s.immortal(id) || s.tasks.has(taskKey{id, batch}) {
+			return nil
+		}
+		if s.cfg.RestartOverlap > 0 {
+			s.startTask(ctx, id, batch, s.cycle(num), nil)
+			go func() {
+				if s.sleep(ctx, s.cfg.RestartOverlap) {
+					s.tasks.stop(id, batch)
+				}
+			}()
+			return nil
+		}
+		wait := s.tasks.stop(id, batch)
+		// A draining predecessor overlaps with its successor, unless its
+		// final values have to be carried over.
+		if s.cfg.Drain > 0 && !s.cfg.PreserveOnRestart {
+			s.startTask(ctx, id, batch, s.cycle(num), nil)
+			return nil
+		}
+		return func() {
+			wait()
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			// Scaling might have removed or started the task in the
+			// meantime.
+			if id < s.num && !s.tasks.has(taskKey{id, batch}) {
+				s.startTask(ctx, id, batch, s.cycle(num), nil)
+			}
+		}
+	})
+	if ok {
+		s.log.Info("Restart batch complete", "batch", batch)
+		s.publish(Event{Type: EventBatchComplete, Batch: batch})
+	}
+	return ok
+}
+
+// switchBatch starts all tasks of the given batch at once and stops all tasks
+// of earlier batches BGOverlap later, for StrategyBlueGreen. It returns false
+// if ctx is done before.
+func (s *Simulator) switchBatch(ctx context.Context, batch int) bool {
+	s.mtx.Lock()
+	for id := s.cfg.Immortal; id < s.num; id++ {
+		// Scaling might have started the task already.
+		if !s.tasks.has(taskKey{id, batch}) {
+			s.startTask(ctx, id, batch, s.cycle(s.num), nil)
+		}
+	}
+	s.mtx.Unlock()
+	// Halfway through once both batches are running.
+	s.metrics.restartProgress.Set(0.5)
+	if !s.sleep(ctx, s.cfg.BGOverlap) {
+		return false
+	}
+	s.mtx.Lock()
+	for id := s.cfg.Immortal; id < s.num; id++ {
+		s.tasks.stop(id, batch)
+	}
+	s.mtx.Unlock()
+	return true
+}
+
+// immortal returns whether the task with the given id is never restarted, see
+// Immortal.
+func (s *Simulator) immortal(id int) bool {
+	return id < s.cfg.Immortal
+}
+
+// atOnce returns whether the given restart batch replaces all tasks at once
+// rather than spread over RestartDuration, which only the first one does with
+// PrestartUniform.
+func (s *Simulator) atOnce(batch int) bool {
+	return batch == 1 && s.cfg.Prestart == PrestartUniform
+}
+
+// roll calls f for the task ids from 0 to num-1 in the restart order of the
+// given batch, spread over RestartDuration (plus CanaryBake after the
+// canaries) unless it is to replace them at once, along with the position i
+// of each id in that order. Ids removed by scaling in the meantime are skipped.
+// f is called with s.mtx held. If it returns a function, roll calls that after
+// releasing s.mtx, for anything that has to wait, like for a stopping task to
+// be gone. roll returns false if ctx is done before f has been called for all
+// ids.
+func (s *Simulator) roll(ctx context.Context, batch, num int, f func(i, id int) func()) bool {
+	canaries, step := s.canaries(num), s.cfg.RestartDuration/time.Duration(num)
+	if s.atOnce(batch) {
+		canaries, step = 0, 0
+	}
+	for i, id := range s.restartOrder(batch, num) {
+		if i == canaries && canaries > 0 {
+			s.log.Info("Baking canaries", "canaries", canaries, "bake", s.cfg.CanaryBake)
+			if !s.sleep(ctx, s.cfg.CanaryBake) {
+				return false
+			}
+		}
+		var then func()
+		s.mtx.Lock()
+		if id < s.num {
+			then = f(i, id)
+		}
+		s.mtx.Unlock()
+		if then != nil {
+			then()
+		}
+		if !s.sleep(ctx, step) {
+			return false
+		}
+	}
+	return true
+}
+
+// restartOrder returns the task ids from 0 to num-1 in the order in which the
+// given restart batch replaces them, see RestartOrder.
+func (s *Simulator) restartOrder(batch, num int) []int {
+	order := make([]int, num)
+	for i := range order {
+		order[i] = i
+	}
+	switch s.cfg.RestartOrder {
+	case RestartOrderReverse:
+		slices.Reverse(order)
+	case RestartOrderRandom:
+		rng := rand.New(rand.NewSource(s.cfg.Seed + int64(batch)))
+		rng.Shuffle(num, func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	return order
+}
+
+// runScaleEvents applies the ScaleEvents at their time after the start of the
+// simulation until ctx is done. The tasks started run until taskCtx is done.
+func (s *Simulator) runScaleEvents(ctx, taskCtx context.Context) {
+	for _, e := range s.cfg.ScaleEvents {
+		if !sleep(ctx, time.Until(s.start.Add(e.At))) {
+			return
+		}
+		s.scale(taskCtx, e.Delta)
+	}
+}
+
+// scale starts delta new tasks in the current batch or, if delta is negative,
+// stops the -delta tasks with the highest ids.
+func (s *Simulator) scale(ctx context.Context, delta int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	from := s.num
+	if delta < 0 {
+		delta = max(delta, -s.num)
+		for id := s.num + delta; id < s.num; id++ {
+			s.tasks.stop(id, math.MaxInt) // Don't wait for a Drain.
+		}
+	}
+	for id := s.num; id < s.num+delta; id++ {
+		s.startTask(ctx, id, s.batch, s.cycle(s.num+delta), nil)
+	}
+	s.num += delta
+	s.log.Info("Scaled tasks", "from", from, "to", s.num)
+	s.publish(Event{Type: EventScale, Batch: s.batch, Tasks: s.num})
+}
+
+// ErrNotRunning is returned by Restart if the simulation is not running.
+var ErrNotRunning = errors.New("simulation not running")
+
+// Restart triggers a restart batch right away and returns its batch number. If
+// a restart batch is currently in progress, Restart waits for it to complete
+// first, or for ctx to be done. In the latter case, ctx.Err() is returned.
+func (s *Simulator) Restart(ctx context.Context) (int, error) {
+	reply := make(chan int, 1)
+	select {
+	case s.restartRequests <- reply:
+		return <-reply, nil
+	case <-s.finished:
+		return 0, ErrNotRunning
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *Simulator) startTask(ctx context.Context, id, batch int, duration time.Duration, started func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	// With a Drain, stopping the task via the taskSet only lets it drain
+	// (and then stop on its own), while ctx being done still stops it
+	// right away.
+	drainCtx, drain := context.WithCancel(context.Background())
+	stop := cancel
+	if s.cfg.Drain > 0 {
+		stop = drain
+	}
+	gone, finish := s.tasks.add(taskKey{id, batch}, stop)
+	w := s.sched.worker()
+	w.schedule(time.Now(), func() {
+		s.runTask(ctx, drainCtx, w, id, batch, duration, started, gone, func() {
+			finish()
+			cancel()
+			drain()
+		})
+	})
+}
+
+type taskKey struct{ id, batch int }
+
+// taskSet keeps track of running tasks so that they can be stopped and waited
+// for.
+type taskSet struct {
+	wg      sync.WaitGroup
+	mtx     sync.Mutex
+	running map[taskKey]runningTask
+}
+
+type runningTask struct {
+	stop func()
+	gone chan struct{} // Closed once the metrics of the task are gone.
+}
+
+func newTaskSet() *taskSet {
+	return &taskSet{running: map[taskKey]runningTask{}}
+}
+
+// add adds the task k, stopped by calling stop, to the running tasks. Of the
+// returned functions, gone has to be called once the metrics of the task are
+// unregistered, and finish once the task has stopped completely.
+func (ts *taskSet) add(k taskKey, stop func()) (gone, finish func()) {
+	t := runningTask{stop: stop, gone: make(chan struct{})}
+	ts.mtx.Lock()
+	ts.running[k] = t
+	ts.mtx.Unlock()
+	ts.wg.Add(1)
+	gone = func() { close(t.gone) }
+	finish = func() {
+		ts.mtx.Lock()
+		delete(ts.running, k)
+		ts.mtx.Unlock()
+		ts.wg.Done()
+	}
+	return gone, finish
+}
+
+// has returns whether the task k is running.
+func (ts *taskSet) has(k taskKey) bool {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	_, ok := ts.running[k]
+	return ok
+}
+
+// stop stops all running tasks with the given id in batches before the given
+// one. The returned function waits for their metrics to be gone (so that
+// PreserveOnRestart can pick up their final values).
+func (ts *taskSet) stop(id, batch int) (wait func()) {
+	var gone []chan struct{}
+	ts.mtx.Lock()
+	for k, t := range ts.running {
+		if k.id == id && k.batch < batch {
+			t.stop()
+			gone = append(gone, t.gone)
+		}
+	}
+	ts.mtx.Unlock()
+	return func() {
+		for _, g := range gone {
+			<-g
+		}
+	}
+}
+
+// wait waits for all tasks to stop or for ctx to be done, whichever happens
+// first. It returns the tasks still running, sorted by batch and id.
+func (ts *taskSet) wait(ctx context.Context) []taskKey {
+	done := make(chan struct{})
+	go func() {
+		ts.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	left := make([]taskKey, 0, len(ts.running))
+	for k := range ts.running {
+		left = append(left, k)
+	}
+	sort.Slice(left, func(i, j int) bool {
+		if left[i].batch != left[j].batch {
+			return left[i].batch < left[j].batch
+		}
+		return left[i].id < left[j].id
+	})
+	return left
+}
+
+// sleep sleeps for d and returns true, or returns false as soon as ctx is
+// done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,319 @@
+package sim
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// testConfig returns a Config for a small, fast simulation that does not
+// restart on its own.
+func testConfig() Config {
+	return Config{
+		Num:             2,
+		RunDuration:     time.Hour,
+		QPS:             100,
+		ShutdownTimeout: 5 * time.Second,
+		Job:             "rrsim",
+		Seed:            1,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// run validates cfg and runs a Simulator for it until the test is done. It
+// returns once the Simulator is ready.
+func run(t *testing.T, cfg Config) *Simulator {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	s := New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "simulation to be ready", s.Ready)
+	return s
+}
+
+// waitFor polls cond until it returns true, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// scrape serves a scrape request with the given Accept header (none if empty)
+// via h.
+func scrape(t *testing.T, h http.Handler, accept string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape returned status %d", resp.StatusCode)
+	}
+	return resp
+}
+
+// scrapeText is like scrape but returns the body.
+func scrapeText(t *testing.T, h http.Handler, accept string) string {
+	t.Helper()
+	b, err := io.ReadAll(scrape(t, h, accept).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRunMaxRestarts(t *testing.T) {
+	cfg := testConfig()
+	cfg.RunDuration = 50 * time.Millisecond
+	cfg.RestartDuration = 20 * time.Millisecond
+	cfg.MaxRestarts = 2
+	s := New(cfg)
+
+	begin := time.Now()
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The last batch starts after two run durations and a restart, and
+	// its last task lives for another run duration and restart.
+	if d, want := time.Since(begin), 3*cfg.RunDuration+2*cfg.RestartDuration; d < want {
+		t.Errorf("Run returned after %v, want at least %v", d, want)
+	}
+	mfs, err := s.reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), namespace+"_") {
+			t.Errorf("metric family %s left registered after Run", mf.GetName())
+		}
+	}
+}
+
+func TestReadyWithoutPrestart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Prestart = PrestartNone
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	s := New(cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(t.Context())
+	}()
+	t.Cleanup(func() { <-done })
+
+	time.Sleep(50 * time.Millisecond)
+	if s.Ready() {
+		t.Fatal("ready before any task has started")
+	}
+	waitFor(t, "restart to be accepted", func() bool {
+		_, err := s.Restart(t.Context())
+		return err == nil
+	})
+	waitFor(t, "simulation to be ready", s.Ready)
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*Config)
+		errs   []string // Substrings of the expected errors, none if valid.
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"no tasks", func(c *Config) { c.Num = 0 }, []string{"number of tasks must be positive"}},
+		{
+			"all numeric errors at once",
+			func(c *Config) {
+				c.Num = -1
+				c.Drain = -time.Second
+				c.ExemplarRate = 2
+			},
+			[]string{"number of tasks", "drain must not be negative", "exemplar rate must be between 0 and 1"},
+		},
+		{"invalid metric name", func(c *Config) { c.MetricName = "query.count" }, []string{"invalid metric name"}},
+		{"invalid namespace", func(c *Config) { c.MetricNamespace = "my-app" }, []string{`invalid metric name "my-app_queries_total"`}},
+		{"invalid label name", func(c *Config) { c.Labels = map[string]string{"__region": "eu"} }, []string{`invalid label name "__region"`}},
+		{"reserved label", func(c *Config) { c.Labels = map[string]string{"task": "x"} }, []string{`label name "task" is reserved`}},
+		{"invalid label name unless UTF-8", func(c *Config) { c.Labels = map[string]string{"cloud.region": "eu"} }, []string{`invalid label name "cloud.region"`}},
+		{
+			"dotted names with UTF-8",
+			func(c *Config) {
+				c.UTF8Names = true
+				c.MetricName = "query.count"
+				c.Labels = map[string]string{"cloud.region": "eu"}
+			},
+			nil,
+		},
+		{"valid label", func(c *Config) { c.Labels = map[string]string{"region": "eu"} }, nil},
+		{
+			"same batch and task label",
+			func(c *Config) {
+				c.BatchLabel = "id"
+				c.TaskLabel = "id"
+			},
+			[]string{`both named "id"`},
+		},
+		{"renamed task label", func(c *Config) { c.TaskLabel = "instance_id" }, nil},
+		{
+			"label clashing with renamed batch label",
+			func(c *Config) {
+				c.BatchLabel = "rev"
+				c.Labels = map[string]string{"rev": "1"}
+			},
+			[]string{`label name "rev" is reserved`},
+		},
+		{"unknown prestart mode", func(c *Config) { c.Prestart = "warm" }, []string{`unknown prestart mode "warm"`}},
+		{"unit without OpenMetrics", func(c *Config) { c.MetricUnit = "queries" }, []string{"requires enabling OpenMetrics"}},
+		{
+			"unit not in name",
+			func(c *Config) {
+				c.EnableOpenMetrics = true
+				c.MetricUnit = "seconds"
+			},
+			[]string{"does not end in its unit"},
+		},
+		{"unknown strategy", func(c *Config) { c.Strategy = "canary" }, []string{`unknown restart strategy "canary"`}},
+		{
+			"negative blue-green overlap",
+			func(c *Config) {
+				c.Strategy = StrategyBlueGreen
+				c.BGOverlap = -time.Second
+			},
+			[]string{"blue-green overlap must not be negative"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			tc.modify(&cfg)
+			err := cfg.Validate()
+			if len(tc.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			var joined interface{ Unwrap() []error }
+			if len(tc.errs) > 1 && (!errors.As(err, &joined) || len(joined.Unwrap()) != len(tc.errs)) {
+				t.Errorf("got %q, want %d errors", err, len(tc.errs))
+			}
+			for _, want := range tc.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q lacks %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProtobufScrape(t *testing.T) {
+	cfg := testConfig()
+	cfg.Histogram = true
+	cfg.NativeHistogram = true
+	cfg.NativeHistogramBucketFactor = 1.1
+	cfg.LatencyMean = 0.1
+	for _, tc := range []struct {
+		name          string
+		defaultFormat string
+		accept        string
+	}{
+		{"negotiated", "", formatAccept[FormatProtobuf]},
+		{"default", FormatProtobuf, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := cfg
+			cfg.DefaultFormat = tc.defaultFormat
+			s := run(t, cfg)
+			waitFor(t, "observed queries", func() bool {
+				resp := scrape(t, s.Handler(), tc.accept)
+				if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/vnd.google.protobuf") {
+					t.Fatalf("got Content-Type %q", ct)
+				}
+				r := bufio.NewReader(resp.Body)
+				families := map[string]*dto.MetricFamily{}
+				for {
+					mf := &dto.MetricFamily{}
+					if err := protodelim.UnmarshalFrom(r, mf); err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("decoding the scrape: %v", err)
+					}
+					families[mf.GetName()] = mf
+				}
+				if n := len(families["queries_total"].GetMetric()); n != cfg.Num {
+					t.Fatalf("got %d series of queries_total, want %d", n, cfg.Num)
+				}
+				// Native histograms are only exposed in the protobuf
+				// format.
+				for _, m := range families["query_duration_seconds"].GetMetric() {
+					if h := m.GetHistogram(); h.GetSampleCount() > 0 && h.GetSchema() != 0 && len(h.PositiveSpan) > 0 {
+						return true
+					}
+				}
+				return false
+			})
+		})
+	}
+}
+
+func TestUTF8Names(t *testing.T) {
+	cfg := testConfig()
+	cfg.UTF8Names = true
+	cfg.MetricName = "query.count"
+	cfg.Labels = map[string]string{"cloud.region": "eu"}
+	s := run(t, cfg)
+	for _, tc := range []struct {
+		name, accept, escaping, series string
+	}{
+		{"no Accept header", "", "allow-utf-8", `{"query.count",batch="0","cloud.region"="eu",task="0"}`},
+		{"allowing UTF-8", "text/plain;version=0.0.4;escaping=allow-utf-8", "allow-utf-8", `{"query.count",batch="0","cloud.region"="eu",task="0"}`},
+		{"legacy scraper", "text/plain;version=0.0.4", "underscores", `query_count{batch="0",cloud_region="eu",task="0"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := scrape(t, s.Handler(), tc.accept)
+			if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "escaping="+tc.escaping) {
+				t.Errorf("got Content-Type %q, want escaping=%s", ct, tc.escaping)
+			}
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), tc.series+" ") {
+				t.Errorf("exposition lacks %s:\n%s", tc.series, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,905 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// taskRand returns a random number generator for the given task, derived
+// deterministically from the global seed, the task id, and the batch, so that
+// each task gets its own stream independent of goroutine scheduling.
+func (s *Simulator) taskRand(id, batch int) *rand.Rand {
+	// Mix the inputs with the SplitMix64 finalizer to avoid correlated
+	// streams for neighboring tasks.
+	x := uint64(s.cfg.Seed) ^ uint64(batch)<<32 ^ uint64(id)
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return rand.New(rand.NewSource(int64(x)))
+}
+
+// minQPSFactor is the lower bound of the time-varying QPS relative to QPS.
+const minQPSFactor = 0.01
+
+// currentQPS returns the average QPS per task, given the configured qps, at the
+// given time elapsed since the start of the simulation.
+func (s *Simulator) currentQPS(qps float64, elapsed time.Duration) float64 {
+	q := qps
+	if s.cfg.QPSAmplitude != 0 && s.cfg.QPSPeriod > 0 {
+		q *= 1 + s.cfg.QPSAmplitude*math.Sin(2*math.Pi*elapsed.Seconds()/s.cfg.QPSPeriod.Seconds())
+	}
+	return math.Max(q, minQPSFactor*qps)
+}
+
+// minWaitFactor is the lower bound of a jittered wait time relative to the
+// mean wait time.
+const minWaitFactor = 0.01
+
+// memNoise is the standard deviation of the simulated resident memory relative
+// to MemBaseline.
+const memNoise = 0.01
+
+// minWarmupFactor is the QPS relative to the full QPS at the start of the
+// warmup of a task.
+const minWarmupFactor = 0.1
+
+// warmupFactor returns the factor to apply to the QPS of a task of the given
+// age, ramping up linearly from minWarmupFactor to 1 during the Warmup.
+func (s *Simulator) warmupFactor(age time.Duration) float64 {
+	if age >= s.cfg.Warmup {
+		return 1
+	}
+	return minWarmupFactor + (1-minWarmupFactor)*float64(age)/float64(s.cfg.Warmup)
+}
+
+// batchFactor returns the factor to apply to the QPS of a task in the given
+// restart batch, changing by QPSRamp with each batch.
+func (s *Simulator) batchFactor(batch int) float64 {
+	if s.cfg.QPSRamp == 0 {
+		return 1
+	}
+	return math.Max(math.Pow(1+s.cfg.QPSRamp, float64(batch)), minQPSFactor)
+}
+
+// taskFactor returns the factor to apply to the QPS of a single task for its
+// whole lifetime, normal-distributed with σ = QPSVariance around 1.
+func (s *Simulator) taskFactor(rng *rand.Rand) float64 {
+	if s.cfg.QPSVariance == 0 {
+		return 1
+	}
+	return math.Max(1+rng.NormFloat64()*s.cfg.QPSVariance, minQPSFactor)
+}
+
+// drainFactor returns the factor to apply to the QPS of a task that has started
+// to drain at drainStart, ramping down linearly from 1 to minQPSFactor during
+// the Drain. A zero drainStart means the task is not draining.
+func (s *Simulator) drainFactor(drainStart time.Time) float64 {
+	if drainStart.IsZero() {
+		return 1
+	}
+	return math.Max(1-float64(time.Since(drainStart))/float64(s.cfg.Drain), minQPSFactor)
+}
+
+// waitDurationNs returns the time to wait until the next query of a task
+// started at taskStart, with qpsFactor applied to the QPS (see batchFactor and
+// taskFactor).
+func (s *Simulator) waitDurationNs(rng *rand.Rand, qpsFactor float64, taskStart time.Time) float64 {
+	p := s.Params()
+	now := time.Now()
+	qps := s.currentQPS(p.QPS, now.Sub(s.start)) * qpsFactor * s.warmupFactor(now.Sub(taskStart))
+	if !(qps > 0) {
+		// Validation should prevent this, but don't wait forever in
+		// case it doesn't. Check again in a second instead.
+		return float64(time.Second)
+	}
+	if s.cfg.Deterministic {
+		return 1e9 / qps
+	}
+	if s.cfg.Arrival == ArrivalPoisson {
+		return 1e9 * rng.ExpFloat64() / qps
+	}
+	var f float64
+	switch s.cfg.JitterDist {
+	case JitterUniform:
+		f = 1 + p.Jitter*(2*rng.Float64()-1)
+	case JitterLognormal:
+		// Shift by σ²/2 to keep the mean at 1.
+		f = math.Exp(rng.NormFloat64()*p.Jitter - p.Jitter*p.Jitter/2)
+	default:
+		f = rng.NormFloat64()*p.Jitter + 1
+	}
+	return 1e9 * math.Max(f, minWaitFactor) / qps
+}
+
+func (s *Simulator) latencySeconds(rng *rand.Rand) float64 {
+	return rng.ExpFloat64() * s.cfg.LatencyMean
+}
+
+// decider makes yes-or-no decisions with a given probability, randomly or, if
+// rng is nil, evenly spread (e.g. yes for every fourth decision with a
+// probability of 0.25).
+type decider struct {
+	rng *rand.Rand
+	acc float64
+}
+
+// newDecider returns a decider using rng, or making evenly spread decisions
+// if Deterministic is set.
+func (s *Simulator) newDecider(rng *rand.Rand) *decider {
+	if s.cfg.Deterministic {
+		return &decider{}
+	}
+	return &decider{rng: rng}
+}
+
+func (d *decider) decide(p float64) bool {
+	if d.rng != nil {
+		return d.rng.Float64() < p
+	}
+	d.acc += p
+	if d.acc >= 1 {
+		d.acc--
+		return true
+	}
+	return false
+}
+
+// syncBurst returns whether all tasks burst during the second of now for
+// BurstSync. The decision only depends on the seed and the second.
+func (s *Simulator) syncBurst(now time.Time) bool {
+	return rand.New(rand.NewSource(s.cfg.Seed^now.Unix())).Float64() < s.cfg.BurstRate
+}
+
+// extraCounterTemplates are the names and increments per query of the counters
+// created for ExtraCounters.
+var extraCounterTemplates = []struct {
+	name  string
+	scale float64
+}{
+	{"bytes_total", 2048},
+	{"requests_total", 1},
+	{"rows_total", 25},
+	{"cache_lookups_total", 3},
+	{"backend_calls_total", 2},
+	{"log_lines_total", 5},
+}
+
+type scaledCounter struct {
+	prometheus.Counter
+	scale float64
+}
+
+// extraCounters returns the counters for ExtraCounters, cycling through
+// extraCounterTemplates and adding a number to the names from the second
+// cycle on.
+func (s *Simulator) extraCounters(labels prometheus.Labels) []scaledCounter {
+	var cs []scaledCounter
+	for i := 0; len(cs) < s.cfg.ExtraCounters; i++ {
+		t := extraCounterTemplates[i%len(extraCounterTemplates)]
+		name := t.name
+		if cycle := i / len(extraCounterTemplates); cycle > 0 {
+			name = fmt.Sprintf("%s_%d_total", strings.TrimSuffix(name, "_total"), cycle)
+		}
+		if name == s.cfg.MetricName {
+			continue
+		}
+		cs = append(cs, scaledCounter{
+			Counter: prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace:   s.cfg.MetricNamespace,
+				Subsystem:   s.cfg.MetricSubsystem,
+				Name:        name,
+				Help:        s.help(name, "An additional (simulated) counter increasing with each query."),
+				ConstLabels: labels,
+			}),
+			scale: t.scale,
+		})
+	}
+	return cs
+}
+
+// constLabels returns the const labels of all metrics of the given task.
+func (s *Simulator) constLabels(id, batch int) prometheus.Labels {
+	labels := make(prometheus.Labels, len(s.cfg.Labels)+2)
+	for name, value := range s.cfg.Labels {
+		labels[name] = value
+	}
+	labels[s.cfg.BatchLabel] = fmt.Sprint(batch)
+	labels[s.cfg.TaskLabel] = fmt.Sprint(id)
+	if s.cfg.Model == ModelProcess {
+		// The same host and port for all batches, as if restarted in
+		// place. Hosts are counted up from 10.0.0.1.
+		n := id + 1
+		labels["instance"] = fmt.Sprintf("10.%d.%d.%d:8080", n>>16&0xff, n>>8&0xff, n&0xff)
+	}
+	return labels
+}
+
+// version returns the version of the tasks in the given batch, which is
+// TaskInfoVersion, counted up by the batch number for VersionRollout. The last
+// number in TaskInfoVersion is counted up, or a number starting at 1 is
+// appended if there is none.
+func (s *Simulator) version(batch int) string {
+	v := s.cfg.TaskInfoVersion
+	if !s.cfg.VersionRollout || batch == 0 {
+		return v
+	}
+	i := len(v)
+	for i > 0 && v[i-1] >= '0' && v[i-1] <= '9' {
+		i--
+	}
+	n, err := strconv.Atoi(v[i:])
+	if err != nil {
+		n = 0
+	}
+	return v[:i] + strconv.Itoa(n+batch)
+}
+
+// counterStart returns the initial value of the query counter of a task.
+func (s *Simulator) counterStart(rng *rand.Rand) float64 {
+	if s.cfg.CounterStartMax > 0 {
+		return math.Floor(rng.Float64() * (s.cfg.CounterStartMax + 1))
+	}
+	return s.cfg.CounterStart
+}
+
+// increment returns the amount a query adds to the query counter.
+func (s *Simulator) increment(rng *rand.Rand) float64 {
+	if s.cfg.IncrementJitter == 0 {
+		return s.cfg.Increment
+	}
+	return s.cfg.Increment + (2*rng.Float64()-1)*s.cfg.IncrementJitter
+}
+
+// help returns the help text of the metric with the given name (without
+// namespace and subsystem), def unless overridden by Help.
+func (s *Simulator) help(name, def string) string {
+	if h, ok := s.cfg.Help[name]; ok {
+		return h
+	}
+	return def
+}
+
+// unit returns u as the unit of a metric if EnableOpenMetrics is set, or ""
+// otherwise, so that the other formats stay as they are.
+func (s *Simulator) unit(u string) string {
+	if !s.cfg.EnableOpenMetrics {
+		return ""
+	}
+	return u
+}
+
+// withLabels returns a new Labels map with the labels of both a and b.
+func withLabels(a, b prometheus.Labels) prometheus.Labels {
+	l := make(prometheus.Labels, len(a)+len(b))
+	for name, value := range a {
+		l[name] = value
+	}
+	for name, value := range b {
+		l[name] = value
+	}
+	return l
+}
+
+// commitOf returns a fake commit hash for the given version.
+func commitOf(version string) string {
+	h := fnv.New32a()
+	h.Write([]byte(version))
+	return fmt.Sprintf("%07x", h.Sum32())[:7]
+}
+
+// traceID returns a random hex-encoded 128bit trace ID.
+func traceID(rng *rand.Rand) string {
+	return fmt.Sprintf("%016x%016x", rng.Uint64(), rng.Uint64())
+}
+
+// runTask starts the task with the given id and batch on w, where it runs
+// until ctx is done, or until it has drained for Drain after drainCtx is done.
+// duration is the expected lifetime of the task, during which it crashes or
+// gets stuck, if at all. If started is not nil, it is called once the metrics
+// of the task are registered. gone is called once they are unregistered for
+// good, and finish once the task has stopped. runTask itself has to be called
+// on w.
+func (s *Simulator) runTask(ctx, drainCtx context.Context, w *worker, id, batch int, duration time.Duration, started, gone, finish func()) {
+	log := s.log.With("task", id, "batch", batch)
+	log.Debug("Starting task", "duration", duration)
+
+	s.metrics.activeTasks.Add(1)
+	s.metrics.batchTasks.add(batch, 1)
+	taskStart := time.Now()
+
+	rng := s.taskRand(id, batch)
+
+	labels := s.constLabels(id, batch)
+	cntOpts := prometheus.CounterOpts{
+		Namespace:   s.cfg.MetricNamespace,
+		Subsystem:   s.cfg.MetricSubsystem,
+		Name:        s.cfg.MetricName,
+		Help:        s.cfg.MetricHelp,
+		Unit:        s.cfg.MetricUnit,
+		ConstLabels: labels,
+	}
+	version := s.version(batch)
+	if s.cfg.VersionLabel {
+		cntOpts.ConstLabels = withLabels(labels, prometheus.Labels{"version": version})
+	}
+	incCounter := func(c prometheus.Counter) {
+		if s.cfg.Exemplars && s.cfg.EnableOpenMetrics && rng.Float64() < s.cfg.ExemplarRate {
+			if ea, ok := c.(prometheus.ExemplarAdder); ok {
+				ea.AddWithExemplar(s.increment(rng), prometheus.Labels{"trace_id": traceID(rng)})
+				return
+			}
+		}
+		c.Add(s.increment(rng))
+	}
+	var (
+		collectors []prometheus.Collector
+		counters   map[string]prometheus.Counter // By status label value.
+	)
+	switch {
+	case s.cfg.SpuriousResetRate > 0:
+		// Only a custom counter can be reset in place.
+		statuses := []string{""}
+		if s.cfg.ErrorRate > 0 {
+			statuses = []string{"success", "error"}
+		}
+		counters = map[string]prometheus.Counter{}
+		for _, status := range statuses {
+			opts := cntOpts
+			if status != "" {
+				opts.ConstLabels = withLabels(opts.ConstLabels, prometheus.Labels{"status": status})
+			}
+			cnt := newResettableCounter(opts)
+			collectors = append(collectors, cnt)
+			counters[status] = cnt
+		}
+	case s.cfg.ErrorRate > 0:
+		cnt := prometheus.NewCounterVec(cntOpts, []string{"status"})
+		// Create both series right away so that both are exposed
+		// before the first error happens.
+		collectors = append(collectors, cnt)
+		counters = map[string]prometheus.Counter{
+			"success": cnt.WithLabelValues("success"),
+			"error":   cnt.WithLabelValues("error"),
+		}
+	default:
+		cnt := prometheus.NewCounter(cntOpts)
+		collectors = append(collectors, cnt)
+		counters = map[string]prometheus.Counter{"": cnt}
+	}
+	// The query counters are the first queryCollectors collectors.
+	queryCollectors := len(collectors)
+	failures := s.newDecider(rng)
+	inc := func() {
+		status := ""
+		if s.cfg.ErrorRate > 0 {
+			status = "success"
+			if failures.decide(s.Params().ErrorRate) {
+				status = "error"
+			}
+		}
+		incCounter(counters[status])
+	}
+	extras := s.extraCounters(labels)
+	for _, e := range extras {
+		collectors = append(collectors, e.Counter)
+	}
+	// burst adds BurstSize queries at once, split into successes and
+	// errors according to ErrorRate.
+	burst := func() {
+		n, status := float64(s.cfg.BurstSize), ""
+		if s.cfg.ErrorRate > 0 {
+			errs := math.Round(n * s.Params().ErrorRate)
+			counters["error"].Add(errs * s.cfg.Increment)
+			n -= errs
+			status = "success"
+		}
+		counters[status].Add(n * s.cfg.Increment)
+		for _, e := range extras {
+			e.Add(e.scale * float64(s.cfg.BurstSize))
+		}
+	}
+	if s.cfg.TaskInfo {
+		info := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "task_info",
+			Help: s.help("task_info", "Information about the (simulated) task, always 1."),
+			ConstLabels: withLabels(labels, prometheus.Labels{
+				"version": version,
+				"zone":    s.cfg.TaskInfoZones[id%len(s.cfg.TaskInfoZones)],
+				"commit":  commitOf(version),
+			}),
+		})
+		info.Set(1)
+		collectors = append(collectors, info)
+	}
+	var churn *churner
+	if s.cfg.Churn {
+		churn = newChurner(labels, s.help("path_requests_total", churnHelp), s.cfg.ChurnCardinality, s.cfg.ChurnTTL, rng)
+		collectors = append(collectors, churn.vec)
+	}
+	var latency prometheus.Observer
+	if s.cfg.Histogram {
+		opts := prometheus.HistogramOpts{
+			Name:        "query_duration_seconds",
+			Help:        s.help("query_duration_seconds", "Duration of the (simulated) queries the task has served."),
+			Unit:        s.unit("seconds"),
+			Buckets:     s.cfg.HistogramBuckets,
+			ConstLabels: labels,
+		}
+		if s.cfg.NativeHistogram {
+			opts.NativeHistogramBucketFactor = s.cfg.NativeHistogramBucketFactor
+			opts.NativeHistogramMaxBucketNumber = s.cfg.NativeHistogramMaxBucketNumber
+			if s.cfg.NativeHistogramOnly {
+				// Without explicit buckets, a native histogram
+				// has no classic buckets.
+				opts.Buckets = nil
+			}
+		}
+		hist := prometheus.NewHistogram(opts)
+		collectors = append(collectors, hist)
+		latency = hist
+	}
+	if s.cfg.Summary {
+		summary := prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:        "query_duration_seconds",
+			Help:        s.help("query_duration_seconds", "Duration of the (simulated) queries the task has served."),
+			Unit:        s.unit("seconds"),
+			Objectives:  s.cfg.SummaryObjectives,
+			ConstLabels: labels,
+		})
+		collectors = append(collectors, summary)
+		latency = summary
+	}
+	var inFlight prometheus.Gauge
+	if s.cfg.Gauge {
+		inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "queries_in_flight",
+			Help:        s.help("queries_in_flight", "Number of (simulated) queries the task is currently serving."),
+			ConstLabels: labels,
+		})
+		collectors = append(collectors, inFlight)
+	}
+	if s.cfg.Uptime {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "task_uptime_seconds",
+			Help:        s.help("task_uptime_seconds", "Time since the task has started."),
+			Unit:        s.unit("seconds"),
+			ConstLabels: labels,
+		}, func() float64 { return time.Since(taskStart).Seconds() }))
+	}
+	var (
+		temperature prometheus.Gauge
+		walk        func()
+	)
+	if s.cfg.RandomWalk {
+		temperature = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "temperature_celsius",
+			Help:        s.help("temperature_celsius", "A (simulated) temperature performing a bounded random walk."),
+			Unit:        s.unit("celsius"),
+			ConstLabels: labels,
+		})
+		collectors = append(collectors, temperature)
+		lo, hi := s.cfg.RandomWalkMin, s.cfg.RandomWalkMax
+		v := lo + rng.Float64()*(hi-lo)
+		temperature.Set(v)
+		walk = func() {
+			v = math.Min(hi, math.Max(lo, v+(2*rng.Float64()-1)*s.cfg.RandomWalkStep))
+			temperature.Set(v)
+		}
+	}
+	var setDebugValue func()
+	if s.cfg.SpecialFloats {
+		debugValue := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "debug_value",
+			Help:        s.help("debug_value", "A random value between 0 and 1 that is now and then NaN, +Inf, or -Inf, to test the handling of special float values."),
+			ConstLabels: labels,
+		})
+		collectors = append(collectors, debugValue)
+		specials := []float64{math.NaN(), math.Inf(1), math.Inf(-1)}
+		setDebugValue = func() {
+			if rng.Float64() < s.cfg.SpecialFloatRate {
+				debugValue.Set(specials[rng.Intn(len(specials))])
+				return
+			}
+			debugValue.Set(rng.Float64())
+		}
+		setDebugValue()
+	}
+	var setMemory func()
+	if s.cfg.MemGrowth > 0 {
+		memory := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "task_resident_memory_bytes",
+			Help:        s.help("task_resident_memory_bytes", "The (simulated) resident memory of the task, leaking until the task restarts."),
+			Unit:        s.unit("bytes"),
+			ConstLabels: labels,
+		})
+		collectors = append(collectors, memory)
+		setMemory = func() {
+			v := s.cfg.MemBaseline + s.cfg.MemGrowth*time.Since(taskStart).Seconds()
+			memory.Set(math.Max(0, math.Round(v+rng.NormFloat64()*memNoise*s.cfg.MemBaseline)))
+		}
+		setMemory()
+	}
+
+	exposed := collectors
+	if s.cfg.TimestampSkew != 0 || s.cfg.OutOfOrderRate > 0 {
+		exposed = make([]prometheus.Collector, len(collectors))
+		for i, c := range collectors {
+			switch {
+			case i < queryCollectors && s.cfg.OutOfOrderRate > 0:
+				exposed[i] = &outOfOrderCollector{
+					Collector: c,
+					rate:      s.cfg.OutOfOrderRate,
+					age:       s.cfg.OutOfOrderAge,
+					skew:      s.cfg.TimestampSkew,
+					samples:   s.metrics.outOfOrder,
+					rng:       rand.New(rand.NewSource(rng.Int63())),
+				}
+			case s.cfg.TimestampSkew != 0:
+				exposed[i] = skewedCollector{c, s.cfg.TimestampSkew}
+			default:
+				exposed[i] = c
+			}
+		}
+	}
+	reg := s.taskRegisterer(batch)
+	// With RoleFlipRate, the query counters are registered with roleReg,
+	// which adds the current role label.
+	var (
+		role    string
+		roleReg prometheus.Registerer
+	)
+	if s.cfg.RoleFlipRate > 0 {
+		role = s.cfg.Roles[rng.Intn(len(s.cfg.Roles))]
+		roleReg = prometheus.WrapRegistererWith(prometheus.Labels{"role": role}, reg)
+	}
+	// registered are the collectors in exposed that are currently
+	// registered, along with the Registerer used. A collector colliding
+	// with one registered already, e.g. by another task with the same
+	// labels, is skipped rather than crashing the whole simulation.
+	type registration struct {
+		reg   prometheus.Registerer
+		c     prometheus.Collector
+		query bool // One of the query counters.
+	}
+	var registered []registration
+	tryRegister := func(r prometheus.Registerer, c prometheus.Collector) bool {
+		if err := r.Register(c); err != nil {
+			log.Warn("Skipping metric of task", "err", err)
+			s.metrics.registrationConflicts.Inc()
+			return false
+		}
+		return true
+	}
+	register := func() {
+		if s.staleMarkers != nil {
+			s.staleMarkers.drop(taskKey{id, batch})
+		}
+		for i, c := range exposed {
+			r, query := reg, i < queryCollectors
+			if query && roleReg != nil {
+				r = roleReg
+			}
+			if tryRegister(r, c) {
+				registered = append(registered, registration{r, c, query})
+			}
+		}
+	}
+	unregister := func() {
+		for _, rc := range registered {
+			rc.reg.Unregister(rc.c)
+		}
+		registered = nil
+	}
+	// flipRole switches the query counters to a random other role.
+	flipRole := func() {
+		i := rng.Intn(len(s.cfg.Roles) - 1)
+		if s.cfg.Roles[i] == role {
+			i = len(s.cfg.Roles) - 1
+		}
+		role = s.cfg.Roles[i]
+		log.Debug("Flipping role", "role", role)
+		roleReg = prometheus.WrapRegistererWith(prometheus.Labels{"role": role}, reg)
+		kept := registered[:0]
+		for _, rc := range registered {
+			if rc.query {
+				rc.reg.Unregister(rc.c)
+				if !tryRegister(roleReg, rc.c) {
+					continue
+				}
+				rc.reg = roleReg
+			}
+			kept = append(kept, rc)
+		}
+		registered = kept
+	}
+	register()
+	carried := false
+	if s.cfg.PreserveOnRestart {
+		s.carriedValuesMtx.Lock()
+		var values map[string]float64
+		values, carried = s.carriedValues[id]
+		for status, v := range values {
+			if c, ok := counters[status]; ok {
+				c.Add(v)
+			}
+		}
+		s.carriedValuesMtx.Unlock()
+	}
+	// Carried values include the start value already.
+	if start := s.counterStart(rng); start > 0 && !carried {
+		status := ""
+		if s.cfg.ErrorRate > 0 {
+			status = "success"
+		}
+		counters[status].Add(start)
+	}
+	// The pusher is the only part of a task with its own goroutine. The
+	// task only counts as stopped once the pusher is done.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if s.cfg.Pushgateway != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pushTask(log, id, batch, collectors, done)
+		}()
+	}
+	s.publishTask(EventTaskStart, id, batch)
+	s.firstStart()
+	if started != nil {
+		started()
+	}
+
+	// All the following runs on w, i.e. never concurrently. Events
+	// scheduled before the task has crashed or stopped are ignored
+	// afterwards. In particular, queries still in flight are abandoned
+	// rather than completed, so that the gauge never drops below zero.
+	var (
+		stopped, crashed bool
+		stuck            bool // No more queries, see StuckRate.
+		lost             bool // While unregistered to simulate a lost scrape.
+		stopOnCancel     func() bool
+		stopOnDrain      func() bool
+		drainStart       time.Time // Zero unless draining.
+		// pending are the events scheduled by the task that have not
+		// run yet. They are canceled once the task stops so that the
+		// task doesn't linger in memory until they would have run.
+		pending = map[*event]struct{}{}
+	)
+	schedule := func(at time.Time, f func()) {
+		var e *event
+		e = w.schedule(at, func() {
+			delete(pending, e)
+			f()
+		})
+		pending[e] = struct{}{}
+	}
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		stopOnCancel()
+		stopOnDrain()
+		for e := range pending {
+			w.cancel(e)
+		}
+		pending = nil
+		if !crashed {
+			log.Debug("Stopping task")
+		}
+		if s.staleMarkers != nil && !lost {
+			s.staleMarkers.add(taskKey{id, batch}, collectors)
+		}
+		unregister()
+		s.releaseRegisterer(batch)
+		s.publishTask(EventTaskStop, id, batch)
+		if s.cfg.PreserveOnRestart {
+			values := make(map[string]float64, len(counters))
+			for status, c := range counters {
+				var m dto.Metric
+				if err := c.Write(&m); err == nil {
+					values[status] = m.GetCounter().GetValue()
+				}
+			}
+			s.carriedValuesMtx.Lock()
+			s.carriedValues[id] = values
+			s.carriedValuesMtx.Unlock()
+		}
+		gone()
+		s.metrics.activeTasks.Add(-1)
+		s.metrics.batchTasks.add(batch, -1)
+		close(done)
+		if s.cfg.Pushgateway == "" {
+			finish()
+			return
+		}
+		go func() {
+			wg.Wait()
+			finish()
+		}()
+	}
+	// after runs f after d unless the task has crashed or stopped by then.
+	after := func(d time.Duration, f func()) {
+		schedule(time.Now().Add(d), func() {
+			if !stopped && !crashed {
+				f()
+			}
+		})
+	}
+	// every runs f every interval, like a time.Ticker dropping ticks if
+	// the worker falls behind.
+	every := func(interval time.Duration, f func()) {
+		var tick func(at time.Time)
+		tick = func(at time.Time) {
+			schedule(at, func() {
+				if stopped || crashed {
+					return
+				}
+				f()
+				next, now := at.Add(interval), time.Now()
+				for !next.After(now) {
+					next = next.Add(interval)
+				}
+				tick(next)
+			})
+		}
+		tick(taskStart.Add(interval))
+	}
+	stopOnCancel = context.AfterFunc(ctx, func() {
+		w.schedule(time.Now(), stop)
+	})
+	stopOnDrain = context.AfterFunc(drainCtx, func() {
+		w.schedule(time.Now(), func() {
+			if stopped || !drainStart.IsZero() {
+				return
+			}
+			if crashed {
+				stop()
+				return
+			}
+			log.Debug("Draining task", "drain", s.cfg.Drain)
+			drainStart = time.Now()
+			schedule(drainStart.Add(s.cfg.Drain), stop)
+		})
+	})
+
+	qpsFactor := s.batchFactor(batch) * s.taskFactor(rng)
+	var (
+		queries   int       // Served so far, for MaxQueries.
+		lastQuery time.Time // Zero before the first query and while paused.
+	)
+	// serve serves a single query.
+	serve := func() {
+		now := time.Now()
+		if !lastQuery.IsZero() {
+			s.metrics.queryInterval.Observe(now.Sub(lastQuery).Seconds())
+		}
+		lastQuery = now
+		inc()
+		queries++
+		for _, e := range extras {
+			e.Add(e.scale)
+		}
+		if churn != nil {
+			churn.inc(now)
+		}
+		if latency != nil {
+			latency.Observe(s.latencySeconds(rng))
+		}
+		if inFlight != nil {
+			inFlight.Inc()
+			after(time.Duration(rng.ExpFloat64()*float64(s.cfg.ServiceTime)), inFlight.Dec)
+		}
+		if walk != nil {
+			walk()
+		}
+	}
+	var query func()
+	query = func() {
+		if stuck {
+			return
+		}
+		// While paused, queries are skipped rather than delayed.
+		if s.Paused() {
+			lastQuery = time.Time{}
+		} else {
+			serve()
+			if s.cfg.MaxQueries > 0 && queries >= s.cfg.MaxQueries {
+				log.Debug("Maximum number of queries served, idling", "queries", queries)
+				return
+			}
+		}
+		after(time.Duration(s.waitDurationNs(rng, qpsFactor*s.drainFactor(drainStart), taskStart)), query)
+	}
+	// The first query happens at a random time during the first wait, or
+	// halfway through it if Deterministic is set.
+	first := 0.5
+	if !s.cfg.Deterministic {
+		first = rng.Float64()
+	}
+	after(time.Duration(s.waitDurationNs(rng, qpsFactor, taskStart)*first), query)
+	// ticker drives the random events with a per-second probability.
+	every(time.Second, func() {
+		if s.Paused() {
+			return
+		}
+		if setDebugValue != nil {
+			setDebugValue()
+		}
+		if setMemory != nil {
+			setMemory()
+		}
+		if churn != nil {
+			churn.tick(time.Now())
+		}
+		if s.cfg.RoleFlipRate > 0 && rng.Float64() < s.cfg.RoleFlipRate {
+			flipRole()
+		}
+		if s.cfg.SpuriousResetRate > 0 && rng.Float64() < s.cfg.SpuriousResetRate {
+			log.Debug("Resetting counter spuriously")
+			for _, c := range counters {
+				c.(*resettableCounter).reset(rng.Float64())
+			}
+		}
+		if s.cfg.BurstRate > 0 && !stuck && (s.cfg.MaxQueries == 0 || queries < s.cfg.MaxQueries) {
+			if s.cfg.BurstSync && s.syncBurst(time.Now()) || !s.cfg.BurstSync && rng.Float64() < s.cfg.BurstRate {
+				log.Debug("Bursting", "queries", s.cfg.BurstSize)
+				burst()
+			}
+		}
+	})
+	losses := s.newDecider(rng)
+	every(s.cfg.LossCheckInterval, func() {
+		if !s.cfg.CorrelatedLoss && !lost && losses.decide(s.Params().Loss) {
+			unregister()
+			s.metrics.lossEvents.Inc()
+			s.publishTask(EventLoss, id, batch)
+			lost = true
+			after(s.cfg.LossDuration, func() {
+				lost = false
+				register()
+			})
+		}
+	})
+	// A crashing task ends at a random time during its lifetime.
+	if s.cfg.CrashRate > 0 && rng.Float64() < s.cfg.CrashRate {
+		after(time.Duration(rng.Float64()*float64(duration)), func() {
+			crashed = true
+			s.publishTask(EventTaskCrash, id, batch)
+			if s.cfg.CrashHang == 0 {
+				log.Warn("Task crashed")
+				stop()
+				return
+			}
+			log.Warn("Task hangs before crashing", "hang", s.cfg.CrashHang)
+			// Keep exposing the frozen metrics for a while.
+			schedule(time.Now().Add(s.cfg.CrashHang), func() {
+				if !stopped {
+					log.Warn("Task crashed")
+					stop()
+				}
+			})
+		})
+	}
+	// A stuck task stops serving queries at a random time during its
+	// lifetime but otherwise keeps running.
+	if s.cfg.StuckRate > 0 && rng.Float64() < s.cfg.StuckRate {
+		after(time.Duration(rng.Float64()*float64(duration)), func() {
+			log.Warn("Task stuck")
+			stuck = true
+			s.publishTask(EventTaskStuck, id, batch)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const openMetricsAccept = "application/openmetrics-text; version=1.0.0"
+
+func TestCurrentQPS(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		amplitude float64
+		period    time.Duration
+		elapsed   time.Duration
+		want      float64
+	}{
+		{"constant", 0, 0, time.Minute, 100},
+		{"no period", 0.5, 0, 15 * time.Minute, 100},
+		{"start", 0.5, time.Hour, 0, 100},
+		{"peak", 0.5, time.Hour, 15 * time.Minute, 150},
+		{"trough", 0.5, time.Hour, 45 * time.Minute, 50},
+		{"full period", 0.5, time.Hour, time.Hour, 100},
+		{"clamped", 2, time.Hour, 45 * time.Minute, 100 * minQPSFactor},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.QPSAmplitude = tc.amplitude
+			cfg.QPSPeriod = tc.period
+			s := &Simulator{cfg: cfg}
+			if got := s.currentQPS(100, tc.elapsed); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("got %v QPS, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWaitDurationNs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		jitter float64
+	}{
+		{"no jitter", 0},
+		{"jitter", 0.1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Jitter = tc.jitter
+			s := New(cfg)
+			rng := rand.New(rand.NewSource(1))
+			const n = 10000
+			var sum, sumSq float64
+			for i := 0; i < n; i++ {
+				d := s.waitDurationNs(rng, 1, time.Time{})
+				sum += d
+				sumSq += d * d
+			}
+			mean := sum / n
+			stddev := math.Sqrt(sumSq/n - mean*mean)
+			// 100 QPS means a mean wait time of 10ms.
+			if want := 1e7; math.Abs(mean-want) > want*0.01 {
+				t.Errorf("got mean wait time %vns, want %vns", mean, want)
+			}
+			if want := 1e7 * tc.jitter; math.Abs(stddev-want) > 1e7*0.01 {
+				t.Errorf("got wait time σ %vns, want %vns", stddev, want)
+			}
+		})
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	cfg := testConfig()
+	cfg.EnableOpenMetrics = true
+	cfg.Exemplars = true
+	cfg.ExemplarRate = 1
+	s := run(t, cfg)
+	waitFor(t, "an exemplar", func() bool {
+		for _, line := range strings.Split(scrapeText(t, s.Handler(), openMetricsAccept), "\n") {
+			if strings.HasPrefix(line, "queries_total{") && strings.Contains(line, ` # {trace_id="`) {
+				return true
+			}
+		}
+		return false
+	})
+	// The text format has no exemplars.
+	if body := scrapeText(t, s.Handler(), "text/plain"); strings.Contains(body, "trace_id") {
+		t.Errorf("text exposition has exemplars:\n%s", body)
+	}
+}
+
+func TestCreatedAcrossRestart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Num = 1
+	cfg.EnableOpenMetrics = true
+	cfg.EnableOpenMetricsCreated = true
+	s := run(t, cfg)
+	created := func(batch string) float64 {
+		re := regexp.MustCompile(`(?m)^queries_created\{batch="` + batch + `",task="0"\} (\S+)$`)
+		m := re.FindStringSubmatch(scrapeText(t, s.Handler(), openMetricsAccept))
+		if m == nil {
+			return 0
+		}
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	before := created("0")
+	if before == 0 {
+		t.Fatal("no created timestamp for the initial task")
+	}
+
+	// Let the created timestamp of the successor differ.
+	time.Sleep(20 * time.Millisecond)
+	if _, err := s.Restart(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	var after float64
+	waitFor(t, "the restarted task", func() bool {
+		after = created("1")
+		return after != 0
+	})
+	if after <= before {
+		t.Errorf("created timestamp went from %v to %v across the restart", before, after)
+	}
+}
+
+func TestStuckTask(t *testing.T) {
+	cfg := testConfig()
+	cfg.Num = 1
+	cfg.RunDuration = 200 * time.Millisecond
+	cfg.StuckRate = 1
+	s := New(cfg)
+	events, cancel := s.Subscribe()
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(t.Context())
+	}()
+	t.Cleanup(func() { <-done })
+
+	timeout := time.After(5 * time.Second)
+	for stuck := false; !stuck; {
+		select {
+		case e := <-events:
+			if e.Task == nil || *e.Task != 0 || e.Batch != 0 {
+				continue
+			}
+			switch e.Type {
+			case EventTaskStuck:
+				stuck = true
+			case EventTaskStop, EventTaskCrash:
+				t.Fatalf("task stopped with %s before getting stuck", e.Type)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the task to get stuck")
+		}
+	}
+	re := regexp.MustCompile(`(?m)^queries_total\{batch="0",task="0"\} (\S+)$`)
+	queries := func() string {
+		m := re.FindStringSubmatch(scrapeText(t, s.Handler(), ""))
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	}
+	before := queries()
+	time.Sleep(50 * time.Millisecond)
+	// The task may have been restarted in the meantime, which only
+	// leaves a count to compare if it is still around.
+	if after := queries(); before != "" && after != "" && after != before {
+		t.Errorf("stuck task went from %s to %s queries", before, after)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	cfg := testConfig()
+	cfg.EnableOpenMetrics = true
+	cfg.Histogram = true
+	cfg.MetricName = "query_seconds_total"
+	cfg.MetricUnit = "seconds"
+	s := run(t, cfg)
+	body := scrapeText(t, s.Handler(), openMetricsAccept)
+	for _, want := range []string{"# UNIT query_seconds seconds\n", "# UNIT query_duration_seconds seconds\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("OpenMetrics exposition lacks %q:\n%s", want, body)
+		}
+	}
+	if body := scrapeText(t, s.Handler(), "text/plain"); strings.Contains(body, "# UNIT") {
+		t.Errorf("text exposition declares units:\n%s", body)
+	}
+}
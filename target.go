@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beorn7/rrsim/sim"
+)
+
+// target is a simulated scrape target, i.e. a Simulator with its own HTTP
+// server. The server can be taken down and brought up again to simulate a
+// flapping target. Optionally, the admin endpoints are served by a separate
+// HTTP server, which stays up while the target is down.
+type target struct {
+	addr         string
+	sim          *sim.Simulator
+	handler      http.Handler
+	adminAddr    string // Empty if the admin endpoints are served by handler.
+	adminHandler http.Handler
+	tlsCfg       *tls.Config
+	// rng makes the random decisions of flap and of the scrape
+	// middlewares.
+	rng *lockedRand
+
+	mtx      sync.Mutex
+	srv      *http.Server // nil while down.
+	adminSrv *http.Server
+	closed   bool
+}
+
+// newTarget returns a target for addr running a Simulator for cfg, which has to
+// have a non-zero Seed.
+func newTarget(addr string, cfg sim.Config, tlsCfg *tls.Config) *target {
+	return &target{
+		addr:   addr,
+		sim:    sim.New(cfg),
+		tlsCfg: tlsCfg,
+		// Flip the bits to not follow any stream of the simulation.
+		rng: newLockedRand(^cfg.Seed),
+	}
+}
+
+// live reports whether t is currently serving a running simulation.
+func (t *target) live() bool {
+	t.mtx.Lock()
+	up := t.srv != nil
+	t.mtx.Unlock()
+	return up && t.sim.Ready()
+}
+
+// listen starts the HTTP server of t in its own goroutine and returns once it
+// accepts connections. It is a no-op if the server is already running or has
+// been shut down.
+func (t *target) listen() {
+	t.mtx.Lock()
+	if t.srv != nil || t.closed {
+		t.mtx.Unlock()
+		return
+	}
+	srv := &http.Server{Addr: t.addr, Handler: t.handler, TLSConfig: t.tlsCfg}
+	t.srv = srv
+	t.mtx.Unlock()
+	serve(srv)
+}
+
+// listenAdmin starts the admin HTTP server of t, if any, in its own goroutine
+// and returns once it accepts connections.
+func (t *target) listenAdmin() {
+	if t.adminAddr == "" {
+		return
+	}
+	srv := &http.Server{Addr: t.adminAddr, Handler: t.adminHandler, TLSConfig: t.tlsCfg}
+	t.mtx.Lock()
+	t.adminSrv = srv
+	t.mtx.Unlock()
+	serve(srv)
+}
+
+// serve runs srv in its own goroutine and returns once it accepts
+// connections.
+func serve(srv *http.Server) {
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("HTTP server failed", "addr", srv.Addr, "err", err)
+		}
+	}()
+	if err := waitForServer(srv.Addr, 5*time.Second); err != nil {
+		fatal("HTTP server not reachable", "addr", srv.Addr, "err", err)
+	}
+}
+
+// down closes the listener and all connections of the HTTP server of t, so
+// that scrapes fail until listen is called again.
+func (t *target) down() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.srv != nil {
+		t.srv.Close()
+		t.srv = nil
+	}
+}
+
+// shutdown gracefully shuts down the HTTP servers of t for good.
+func (t *target) shutdown(ctx context.Context) error {
+	t.mtx.Lock()
+	srvs := []*http.Server{t.srv, t.adminSrv}
+	t.srv, t.adminSrv = nil, nil
+	t.closed = true
+	t.mtx.Unlock()
+	var errs []error
+	for _, srv := range srvs {
+		if srv != nil {
+			errs = append(errs, srv.Shutdown(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flap takes t down at the given average rate (per minute) for a random
+// duration between downMin and downMax, until ctx is done.
+func (t *target) flap(ctx context.Context, rate float64, downMin, downMax time.Duration) {
+	// wait returns false if ctx is done before d has passed.
+	wait := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	for {
+		if !wait(time.Duration(t.rng.ExpFloat64() / rate * float64(time.Minute))) {
+			return
+		}
+		d := downMin + time.Duration(t.rng.Int63n(int64(downMax-downMin)+1))
+		slog.Info("Target down", "addr", t.addr, "duration", d)
+		t.down()
+		if !wait(d) {
+			return
+		}
+		t.listen()
+		slog.Info("Target up", "addr", t.addr)
+	}
+}
+
+// newMux returns a ServeMux with the HTTP endpoints of a target that are
+// scraped or used for service discovery (with sd as the handler). Unless admin
+// is set, all the other endpoints are added, too.
+func newMux(t *target, sd http.Handler, admin bool) *http.ServeMux {
+	s := t.sim
+	mux := http.NewServeMux()
+	mux.Handle(*metricsPath, scrapeHandler(s.Handler(), t.rng))
+	if *batchPaths {
+		mux.Handle(*metricsPath+"/batch/", scrapeHandler(batchHandler(s), t.rng))
+	}
+	mux.HandleFunc("/", rootHandler)
+	mux.Handle(*sdPath, sd)
+	if !admin {
+		addAdminHandlers(mux, s)
+	}
+	return mux
+}
+
+// scrapeHandler wraps h, which exposes metrics, with the middlewares simulating
+// slow, failing, or protected scrapes as set by the flags, and with the scrape
+// logging, if enabled. All their random decisions are made by rng.
+func scrapeHandler(h http.Handler, rng *lockedRand) http.Handler {
+	if *scrapeErrorRate > 0 {
+		h = errorHandler(h, rng, *scrapeErrorRate, *scrapeErrorCode)
+	}
+	if *scrapeDelay > 0 || *scrapeDelayJitter > 0 {
+		h = delayHandler(h, rng, *scrapeDelay, *scrapeDelayJitter, *scrapeDelayProbability)
+	}
+	if *corruptRate > 0 {
+		h = corruptHandler(h, rng, *corruptRate)
+	}
+	if *jitterScrapeResponse > 0 {
+		h = firstByteDelayHandler(h, rng, *jitterScrapeResponse)
+	}
+	if *basicAuthUser != "" || *basicAuthPassword != "" {
+		h = basicAuthHandler(h, *basicAuthUser, *basicAuthPassword)
+	}
+	if *logScrapes {
+		h = scrapeLogHandler(h, rng, *logScrapesSample)
+	}
+	return h
+}
+
+// batchHandler serves the metrics of restart batch n of s under paths ending
+// in /batch/<n>, or 404 if no task of batch n is running.
+func batchHandler(s *sim.Simulator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := strings.TrimPrefix(r.URL.Path, *metricsPath+"/batch/")
+		batch, err := strconv.Atoi(n)
+		if err != nil || batch < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		h := s.BatchHandler(batch)
+		if h == nil {
+			http.Error(w, fmt.Sprintf("batch %d is not live", batch), http.StatusNotFound)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newAdminMux returns a ServeMux with the admin endpoints of a target.
+func newAdminMux(s *sim.Simulator) *http.ServeMux {
+	mux := http.NewServeMux()
+	addAdminHandlers(mux, s)
+	return mux
+}
+
+// addAdminHandlers adds all the HTTP endpoints of a target to mux that are
+// neither scraped nor used for service discovery.
+func addAdminHandlers(mux *http.ServeMux, s *sim.Simulator) {
+	mux.Handle("/-/config", paramsHandler(s))
+	mux.Handle("/-/restart", restartHandler(s))
+	mux.Handle("/-/pause", pauseHandler(s))
+	mux.Handle("/-/resume", resumeHandler(s))
+	mux.Handle("/-/events", eventsHandler(s))
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	mux.HandleFunc(*healthyPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc(*readyPath, func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// targetAddrs returns n addresses with the host of base and ports counting up
+// from the port of base.
+func targetAddrs(base string, n int) ([]string, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of targets must be positive, got %d", n)
+	}
+	if n == 1 {
+		return []string{base}, nil
+	}
+	host, portStr, err := net.SplitHostPort(base)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 {
+		return nil, fmt.Errorf("multiple targets require a numeric non-zero port, got %q", portStr)
+	}
+	if port+n-1 > 65535 {
+		return nil, fmt.Errorf("port range %d-%d exceeds 65535", port, port+n-1)
+	}
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(port+i))
+	}
+	return addrs, nil
+}
+
+// waitForServer tries to connect to addr until it succeeds or timeout has
+// passed.
+func waitForServer(addr string, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	addr = net.JoinHostPort(host, port)
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}